@@ -1,6 +1,10 @@
 package cmd
 
 import (
+	"errors"
+	"os"
+	"time"
+
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/tanq16/fs-entangle/internal/client"
@@ -16,12 +20,31 @@ var (
 	serverAddr    string
 	clientDir     string
 	clientIgnores string
+	clientCA      string
+	clientTLSCert string
+	clientTLSKey  string
+	clientToken   string
+	clientLinks   string
+	maxRetries    int
+	retryMin      time.Duration
+	retryMax      time.Duration
 )
 
+// exitRetriesExhausted is the exit code when the client gives up reconnecting after --max-retries
+const exitRetriesExhausted = 3
+
 func init() {
 	clientCmd.Flags().StringVarP(&serverAddr, "addr", "a", "ws://localhost:8080/ws", "Address of the fs-entangle server")
 	clientCmd.Flags().StringVarP(&clientDir, "dir", "d", ".", "Directory to sync with the server")
-	clientCmd.Flags().StringVar(&clientIgnores, "ignore", "", "Comma-separated list of glob patterns to ignore for local changes (e.g., 'node_modules/*,*.log')")
+	clientCmd.Flags().StringVar(&clientIgnores, "ignore", "", "Comma-separated list of glob patterns to ignore for local changes (e.g., 'node_modules,*.log')")
+	clientCmd.Flags().StringVar(&clientCA, "ca", "", "CA certificate file to verify a wss:// server with, instead of the system roots")
+	clientCmd.Flags().StringVar(&clientTLSCert, "tls-cert", "", "Client certificate file, for servers that require one")
+	clientCmd.Flags().StringVar(&clientToken, "token", os.Getenv("FS_ENTANGLE_TOKEN"), "Auth token for servers that require one (defaults to $FS_ENTANGLE_TOKEN)")
+	clientCmd.Flags().StringVar(&clientLinks, "symlinks", "preserve", "How to sync symlinks: preserve (as links), follow (as copies of their targets) or skip")
+	clientCmd.Flags().StringVar(&clientTLSKey, "tls-key", "", "Client certificate private key file")
+	clientCmd.Flags().IntVar(&maxRetries, "max-retries", 0, "Reconnect attempts in a row before giving up with exit code 3 (0 retries forever)")
+	clientCmd.Flags().DurationVar(&retryMin, "retry-min", time.Second, "Delay before the first reconnect attempt, doubled after every failure")
+	clientCmd.Flags().DurationVar(&retryMax, "retry-max", time.Minute, "Longest delay between reconnect attempts")
 }
 
 func runClient(cmd *cobra.Command, args []string) {
@@ -30,10 +53,24 @@ func runClient(cmd *cobra.Command, args []string) {
 		ServerAddr:  serverAddr,
 		SyncDir:     clientDir,
 		IgnorePaths: clientIgnores,
+		TLSCA:       clientCA,
+		TLSCert:     clientTLSCert,
+		TLSKey:      clientTLSKey,
+		Token:       clientToken,
+		Symlinks:    clientLinks,
+		MaxRetries:  maxRetries,
+		RetryMin:    retryMin,
+		RetryMax:    retryMax,
 	}
 	c, err := client.New(cfg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize client")
 	}
-	c.Run()
+	if err := c.Run(); err != nil {
+		if errors.Is(err, client.ErrRetriesExhausted) {
+			log.Error().Err(err).Msg("Client stopped")
+			os.Exit(exitRetriesExhausted)
+		}
+		log.Fatal().Err(err).Msg("Client stopped")
+	}
 }
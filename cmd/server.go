@@ -16,20 +16,35 @@ var (
 	serverPort    int
 	serverDir     string
 	serverIgnores string
+	serverTLSCert string
+	serverTLSKey  string
+	serverCA      string
+	serverTokens  string
+	serverLinks   string
 )
 
 func init() {
 	serverCmd.Flags().IntVarP(&serverPort, "port", "p", 8080, "Port for the server to listen on")
 	serverCmd.Flags().StringVarP(&serverDir, "dir", "d", ".", "Directory to sync (server's source of truth)")
-	serverCmd.Flags().StringVar(&serverIgnores, "ignore", "", "Comma-separated list of glob patterns to ignore (e.g., '.git/*,*.tmp')")
+	serverCmd.Flags().StringVar(&serverIgnores, "ignore", "", "Comma-separated list of glob patterns to ignore (e.g., '.git,*.tmp')")
+	serverCmd.Flags().StringVar(&serverTLSCert, "tls-cert", "", "TLS certificate file; serves wss:// when set together with --tls-key")
+	serverCmd.Flags().StringVar(&serverTLSKey, "tls-key", "", "TLS private key file")
+	serverCmd.Flags().StringVar(&serverTokens, "tokens-file", "", "File of name:token lines; clients must present one of the tokens to connect")
+	serverCmd.Flags().StringVar(&serverLinks, "symlinks", "preserve", "How to sync symlinks: preserve (as links), follow (as copies of their targets) or skip")
+	serverCmd.Flags().StringVar(&serverCA, "client-ca", "", "CA certificate file; only clients with a certificate signed by it may connect")
 }
 
 func runServer(cmd *cobra.Command, args []string) {
-	log.Info().Int("port", serverPort).Str("directory", serverDir).Str("ignores", serverIgnores).Msg("Starting fs-entangle server")
+	log.Info().Int("port", serverPort).Str("directory", serverDir).Str("ignores", serverIgnores).Bool("tls", serverTLSCert != "").Bool("client_certs", serverCA != "").Bool("auth", serverTokens != "").Msg("Starting fs-entangle server")
 	cfg := server.Config{
 		Port:        serverPort,
 		SyncDir:     serverDir,
 		IgnorePaths: serverIgnores,
+		TLSCert:     serverTLSCert,
+		TLSKey:      serverTLSKey,
+		TLSClientCA: serverCA,
+		TokensFile:  serverTokens,
+		Symlinks:    serverLinks,
 	}
 	s, err := server.New(cfg)
 	if err != nil {
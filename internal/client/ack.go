@@ -0,0 +1,298 @@
+package client
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+const (
+	// opRetryLimit is how many times a change the server failed to apply is sent again
+	opRetryLimit = 3
+	// opRetryDelay is the wait before the first retry, doubling with every further one
+	opRetryDelay = 2 * time.Second
+)
+
+// unacked tracks the changes sent to the server and not yet answered, so failed ones can be
+// retried and those cut off by a disconnect replayed
+type unacked struct {
+	mu      sync.Mutex
+	entries map[string]sentChange
+	sent    uint64
+	// failures counts the failed attempts at each path since it was last applied
+	failures map[string]int
+	// pinned are the bases of changes being sent again, used in place of the journal's
+	pinned map[string]*string
+	// signing are the writes waiting for the server's signature to be sent as deltas, by path
+	signing map[string]sentChange
+	// retrying are the changes the server failed to apply waiting to be sent again, by ID
+	retrying map[string]scheduledRetry
+}
+
+type sentChange struct {
+	outboxEntry
+	// order is when the change was sent relative to the others
+	order uint64
+	// state is what a write leaves at the path once applied
+	state string
+}
+
+type scheduledRetry struct {
+	change sentChange
+	timer  *time.Timer
+}
+
+func newUnacked() *unacked {
+	return &unacked{
+		entries:  make(map[string]sentChange),
+		failures: make(map[string]int),
+		pinned:   make(map[string]*string),
+		signing:  make(map[string]sentChange),
+		retrying: make(map[string]scheduledRetry),
+	}
+}
+
+// pin makes the next change sent for path use base instead of the synced state
+func (u *unacked) pin(path string, base *string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pinned[path] = base
+}
+
+func (u *unacked) takePin(path string) (*string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	base, ok := u.pinned[path]
+	delete(u.pinned, path)
+	return base, ok
+}
+
+// setState records the state a write leaves once its content was hashed while streaming
+func (u *unacked) setState(id, state string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if change, ok := u.entries[id]; ok {
+		change.state = state
+		u.entries[id] = change
+	}
+}
+
+// ordered returns the unanswered changes in the order they were sent
+func (u *unacked) ordered() []sentChange {
+	return slices.SortedFunc(maps.Values(u.entries), byOrder)
+}
+
+func byOrder(a, b sentChange) int {
+	return cmp.Compare(a.order, b.order)
+}
+
+// awaitSignature records a write waiting for the server's signature, so it is queued again if the
+// connection drops before the delta goes out
+func (c *Client) awaitSignature(path string) {
+	c.unacked.mu.Lock()
+	defer c.unacked.mu.Unlock()
+	c.unacked.sent++
+	change := sentChange{outboxEntry: outboxEntry{Op: common.OpWrite, Path: path}, order: c.unacked.sent}
+	if base, ok := c.unacked.pinned[path]; ok {
+		change.BaseHash = base
+	}
+	c.unacked.signing[path] = change
+}
+
+// signed forgets a write that waited for a signature, once whatever was sent for it is tracked
+func (c *Client) signed(path string) {
+	c.unacked.mu.Lock()
+	defer c.unacked.mu.Unlock()
+	delete(c.unacked.signing, path)
+}
+
+// track gives op an ID for the server to answer, if the server answers operations
+func (c *Client) track(op *common.FileOperationMessage) {
+	if !c.hasCapability(common.CapAcks) {
+		return
+	}
+	op.ID = uuid.NewString()
+	c.unacked.mu.Lock()
+	defer c.unacked.mu.Unlock()
+	c.unacked.sent++
+	change := sentChange{
+		outboxEntry: outboxEntry{Op: op.Op, Path: op.Path, NewPath: op.NewPath, IsDir: op.IsDir, BaseHash: op.BaseHash},
+		order:       c.unacked.sent,
+	}
+	if op.Op == common.OpWrite {
+		change.state = op.ContentHash()
+	}
+	c.unacked.entries[op.ID] = change
+}
+
+// syncedState returns what the server holds for path once the changes sent so far are applied:
+// the journal's last-synced state with every unanswered change on top
+func (c *Client) syncedState(path string) (string, bool) {
+	state, synced := c.journal.Get(path)
+	c.unacked.mu.Lock()
+	defer c.unacked.mu.Unlock()
+	for _, change := range c.unacked.ordered() {
+		switch {
+		case change.Op == common.OpWrite && change.Path == path:
+			state, synced = change.state, true
+		case (change.Op == common.OpRemove || change.Op == common.OpRename) && within(path, change.Path):
+			state, synced = common.StateRemoved, false
+		case change.Op == common.OpRename && within(path, change.NewPath):
+			source, _ := common.RebasePath(path, change.NewPath, change.Path)
+			state, synced = c.journal.Get(source)
+		}
+	}
+	return state, synced
+}
+
+// replace forgets an operation the server asked to have sent again, pinning its base for the
+// operation that replaces it. It is no failure, so it doesn't count toward the retry limit.
+func (c *Client) replace(id string) {
+	c.unacked.mu.Lock()
+	defer c.unacked.mu.Unlock()
+	change, ok := c.unacked.entries[id]
+	if !ok {
+		return
+	}
+	delete(c.unacked.entries, id)
+	c.unacked.pinned[change.Path] = change.BaseHash
+}
+
+// uploading reports whether a change to path is on its way to the server: sent and unanswered,
+// waiting for a signature or a retry, or queued until reconnected
+func (c *Client) uploading(path string) bool {
+	if c.outbox.Has(path) {
+		return true
+	}
+	c.unacked.mu.Lock()
+	defer c.unacked.mu.Unlock()
+	if _, ok := c.unacked.signing[path]; ok {
+		return true
+	}
+	for _, change := range c.unacked.entries {
+		if change.covers(path) {
+			return true
+		}
+	}
+	for _, retry := range c.unacked.retrying {
+		if retry.change.covers(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// untrack forgets an operation that never reached the server
+func (c *Client) untrack(id string) {
+	c.unacked.mu.Lock()
+	defer c.unacked.mu.Unlock()
+	delete(c.unacked.entries, id)
+}
+
+func (c *Client) handleAck(wrapper common.MessageWrapper) {
+	var ack common.AckMessage
+	if err := common.DecodePayload(wrapper, &ack); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal ack")
+		return
+	}
+	// Everything before the operation was broadcast to this connection ahead of the ack
+	c.advance(ack.Seq)
+	c.unacked.mu.Lock()
+	change, ok := c.unacked.entries[ack.ID]
+	if ok {
+		delete(c.unacked.entries, ack.ID)
+		delete(c.unacked.failures, change.Path)
+	}
+	c.unacked.mu.Unlock()
+	if !ok {
+		return
+	}
+	// Only now is the change synced, so anything sent again until here kept its original base
+	switch change.Op {
+	case common.OpRemove:
+		c.journal.DeleteTree(change.Path)
+	case common.OpRename:
+		c.journal.MoveTree(change.Path, change.NewPath)
+	case common.OpWrite:
+		state := ack.State
+		if state == "" {
+			state = change.state
+		}
+		c.journal.Set(change.Path, state)
+	}
+	log.Debug().Str("op", string(change.Op)).Str("path", ack.Path).Msg("Change saved on server")
+}
+
+// handleNack reports a change the server did not apply, sending it again after a while if the
+// failure may be temporary
+func (c *Client) handleNack(wrapper common.MessageWrapper) {
+	var nack common.NackMessage
+	if err := common.DecodePayload(wrapper, &nack); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal nack")
+		return
+	}
+	c.unacked.mu.Lock()
+	defer c.unacked.mu.Unlock()
+	entry, ok := c.unacked.entries[nack.ID]
+	if !ok {
+		return
+	}
+	delete(c.unacked.entries, nack.ID)
+	if !nack.Retry {
+		log.Warn().Str("op", string(entry.Op)).Str("path", nack.Path).Str("reason", nack.Reason).Msg("Server did not apply change")
+		return
+	}
+	c.unacked.failures[entry.Path]++
+	failures := c.unacked.failures[entry.Path]
+	if failures > opRetryLimit {
+		delete(c.unacked.failures, entry.Path)
+		log.Error().Str("op", string(entry.Op)).Str("path", nack.Path).Str("reason", nack.Reason).Int("attempts", failures).Msg("Server failed to apply change, giving up")
+		return
+	}
+	delay := opRetryDelay << (failures - 1)
+	log.Error().Str("op", string(entry.Op)).Str("path", nack.Path).Str("reason", nack.Reason).Str("retry_in", delay.String()).Msg("Server failed to apply change")
+	id := nack.ID
+	c.unacked.retrying[id] = scheduledRetry{change: entry, timer: time.AfterFunc(delay, func() { c.retry(id) })}
+}
+
+// retry sends a change the server failed to apply again, unless a disconnect queued it meanwhile
+func (c *Client) retry(id string) {
+	c.unacked.mu.Lock()
+	scheduled, ok := c.unacked.retrying[id]
+	delete(c.unacked.retrying, id)
+	c.unacked.mu.Unlock()
+	if ok {
+		c.resend(scheduled.change.outboxEntry)
+	}
+}
+
+// requeueUnacked moves the changes the server never answered, along with the writes waiting for a
+// signature or a retry, to the outbox when the connection drops, as they may not have been
+// applied; replaying one that was is a no-op on the server
+func (c *Client) requeueUnacked() {
+	c.unacked.mu.Lock()
+	defer c.unacked.mu.Unlock()
+	pending := slices.Collect(maps.Values(c.unacked.entries))
+	pending = append(pending, slices.Collect(maps.Values(c.unacked.signing))...)
+	for _, scheduled := range c.unacked.retrying {
+		scheduled.timer.Stop()
+		pending = append(pending, scheduled.change)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	log.Warn().Int("count", len(pending)).Msg("Changes not confirmed by server before disconnecting, queued until reconnected")
+	slices.SortFunc(pending, byOrder)
+	for _, change := range pending {
+		c.outbox.Add(change.outboxEntry)
+	}
+	clear(c.unacked.entries)
+	clear(c.unacked.signing)
+	clear(c.unacked.retrying)
+}
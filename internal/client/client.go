@@ -1,12 +1,18 @@
 package client
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -19,47 +25,156 @@ type Config struct {
 	ServerAddr  string
 	SyncDir     string
 	IgnorePaths string
+	// TLSCA pins the CA used to verify a wss:// server instead of the system roots
+	TLSCA   string
+	TLSCert string
+	TLSKey  string
+	// Token authenticates the client to servers that require it
+	Token string
+	// Symlinks is the symlink mode: preserve, follow or skip
+	Symlinks string
+	// MaxRetries is how many reconnects in a row may fail before Run gives up; 0 retries forever
+	MaxRetries int
+	// RetryMin and RetryMax bound the delay between reconnects, which doubles with every failure
+	RetryMin time.Duration
+	RetryMax time.Duration
 }
 
 type Client struct {
-	cfg     Config
-	conn    *websocket.Conn
-	watcher *fsnotify.Watcher
-	ignorer *common.PathIgnorer
-	// isSyncing prevents the watcher from reacting to changes made by the client itself
-	syncingMutex sync.Mutex
-	isSyncing    bool
-	writeMutex   sync.Mutex
+	cfg      Config
+	tls      *tls.Config
+	conn     *websocket.Conn
+	state    atomic.Int32
+	codec    common.Codec
+	caps     common.Capabilities
+	watcher  *fsnotify.Watcher
+	ignorer  *common.PathIgnorer
+	symlinks *common.SymlinkPolicy
+	journal  *journal
+	index    *common.Index
+	outbox   *outbox
+	unacked  *unacked
+	// replayed are the paths the outbox replay sent since connecting, which initial sync skips;
+	// written before the read loop starts and only read by it
+	replayed map[string]bool
+	// expected tracks what the client itself last wrote so its watcher ignores those events
+	expected   *common.ExpectedState
+	writeMutex sync.Mutex
+	// transfers in progress from the server, only touched by the read loop
+	transfers map[string]*common.IncomingTransfer
+	// treeSync is the initial sync by manifest tree in progress, only touched by the read loop
+	treeSync *treeSync
+	// epoch and seq are how far the client got through the server's operation log, resumable
+	// whether it got there through a complete initial sync, and requested the files asked for
+	// and not yet received; only touched by the connection loop and the read loop
+	epoch     string
+	seq       uint64
+	resumable bool
+	requested map[string]bool
+	// renameMutex guards the state used to pair rename events, shared by the watcher and its timers
+	renameMutex    sync.Mutex
+	inodes         map[string]inode
+	pendingRenames map[string]*pendingRename
 }
 
 func New(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.ServerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+	if u.Scheme != "wss" && cfg.Token != "" {
+		log.Warn().Msg("Sending the auth token over an unencrypted ws:// connection")
+	}
+	if u.Scheme != "wss" && (cfg.TLSCA != "" || cfg.TLSCert != "" || cfg.TLSKey != "") {
+		return nil, errors.New("TLS options require a wss:// server address")
+	}
+	if cfg.RetryMin <= 0 {
+		cfg.RetryMin = defaultRetryMin
+	}
+	if cfg.RetryMax <= 0 {
+		cfg.RetryMax = defaultRetryMax
+	}
+	if cfg.RetryMin > cfg.RetryMax {
+		return nil, fmt.Errorf("minimum retry delay %s exceeds maximum %s", cfg.RetryMin, cfg.RetryMax)
+	}
+	tlsConfig, err := common.ClientTLSConfig(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
 	if err := os.MkdirAll(cfg.SyncDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create sync directory: %w", err)
 	}
+	if err := common.ResetTempDir(cfg.SyncDir); err != nil {
+		return nil, fmt.Errorf("failed to prepare temp directory: %w", err)
+	}
+	symlinks, err := common.NewSymlinkPolicy(cfg.SyncDir, cfg.Symlinks)
+	if err != nil {
+		return nil, err
+	}
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file watcher: %w", err)
 	}
+	journal, err := loadJournal(cfg.SyncDir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := common.LoadIndex(cfg.SyncDir)
+	if err != nil {
+		return nil, err
+	}
+	outbox, err := loadOutbox(cfg.SyncDir)
+	if err != nil {
+		return nil, err
+	}
 	return &Client{
-		cfg:     cfg,
-		watcher: watcher,
-		ignorer: common.NewPathIgnorer(cfg.IgnorePaths),
+		cfg:            cfg,
+		tls:            tlsConfig,
+		watcher:        watcher,
+		ignorer:        common.NewPathIgnorer(cfg.SyncDir, cfg.IgnorePaths),
+		symlinks:       symlinks,
+		journal:        journal,
+		index:          index,
+		outbox:         outbox,
+		unacked:        newUnacked(),
+		expected:       common.NewExpectedState(),
+		transfers:      make(map[string]*common.IncomingTransfer),
+		requested:      make(map[string]bool),
+		inodes:         make(map[string]inode),
+		pendingRenames: make(map[string]*pendingRename),
 	}, nil
 }
 
-func (c *Client) Run() {
+var errNotConnected = errors.New("not connected to server")
+
+func (c *Client) Run() error {
 	defer c.watcher.Close()
 	go c.watchFilesystem()
-	for {
+	go c.flushJournal()
+	// attempt counts the reconnects since the client was last live
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if c.cfg.MaxRetries > 0 && attempt > c.cfg.MaxRetries {
+				return fmt.Errorf("%w after %d retries", ErrRetriesExhausted, c.cfg.MaxRetries)
+			}
+			c.backoff(attempt)
+		}
+		c.setState(stateConnecting)
 		err := c.connect()
+		if errors.Is(err, errRejected) {
+			return err
+		}
 		if err != nil {
-			log.Error().Err(err).Msg("Connection failed, retrying in 5 seconds...")
-			time.Sleep(5 * time.Second)
+			log.Error().Err(err).Msg("Connection failed")
 			continue
 		}
+		c.setState(stateSyncing)
+		c.replayOutbox()
 		c.listenToServer()
-		log.Warn().Msg("Disconnected from server. Attempting to reconnect...")
-		time.Sleep(5 * time.Second)
+		if c.currentState() == stateLive {
+			attempt = 0
+		}
+		log.Warn().Msg("Disconnected from server")
 	}
 }
 
@@ -69,160 +184,512 @@ func (c *Client) connect() error {
 		return fmt.Errorf("invalid server URL: %w", err)
 	}
 	log.Info().Str("addr", u.String()).Msg("Connecting to server...")
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = common.Subprotocols
+	dialer.EnableCompression = true
+	dialer.TLSClientConfig = c.tls
+	header := http.Header{}
+	if c.cfg.Token != "" {
+		header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	conn, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("%w: invalid or missing token", errRejected)
+		}
+		return err
+	}
+	codec := common.CodecFor(conn.Subprotocol())
+	caps, err := c.handshake(conn, codec)
 	if err != nil {
+		conn.Close()
 		return err
 	}
+	c.writeMutex.Lock()
 	c.conn = conn
-	log.Info().Str("addr", c.cfg.ServerAddr).Msg("Successfully connected to server")
+	c.codec = codec
+	c.caps = caps
+	c.writeMutex.Unlock()
+	// Outstanding requests went out with the resume point, and whatever the server sends
+	// next covers them
+	c.resumable = false
+	clear(c.requested)
+	log.Info().Str("addr", c.cfg.ServerAddr).Str("codec", codec.Name()).Msg("Successfully connected to server")
 	return nil
 }
 
 func (c *Client) listenToServer() {
-	defer c.conn.Close()
+	c.writeMutex.Lock()
+	conn, codec := c.conn, c.codec
+	c.writeMutex.Unlock()
+	defer func() {
+		c.writeMutex.Lock()
+		c.conn = nil
+		c.writeMutex.Unlock()
+		conn.Close()
+	}()
+	defer c.abortTransfers()
+	defer c.requeueUnacked()
 	for {
-		var wrapper common.MessageWrapper
-		if err := c.conn.ReadJSON(&wrapper); err != nil {
+		frameType, data, err := conn.ReadMessage()
+		if err != nil {
 			log.Error().Err(err).Msg("Error reading from server")
 			return
 		}
-		c.setSyncing(true)
+		wrapper, err := codec.Decode(frameType, data)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to decode message from server")
+			continue
+		}
 		switch wrapper.Type {
 		case common.TypeManifest:
-			c.handleManifest(wrapper.Payload)
+			c.handleManifest(wrapper)
+		case common.TypeManifestTree:
+			c.handleManifestTree(wrapper)
+		case common.TypeResume:
+			c.handleResume(wrapper)
 		case common.TypeFileContent:
-			c.handleFileContent(wrapper.Payload)
+			c.handleFileContent(wrapper)
 		case common.TypeFileOperation:
-			c.handleFileOperation(wrapper.Payload)
+			c.handleFileOperation(wrapper)
+		case common.TypeAck:
+			c.handleAck(wrapper)
+		case common.TypeNack:
+			c.handleNack(wrapper)
+		case common.TypeSignature:
+			c.handleSignature(wrapper)
+		case common.TypeTransferBegin:
+			c.handleTransferBegin(wrapper)
+		case common.TypeTransferChunk:
+			c.handleTransferChunk(wrapper)
+		case common.TypeTransferCommit:
+			c.handleTransferCommit(wrapper)
+		case common.TypeTransferAbort:
+			c.handleTransferAbort(wrapper)
+		case common.TypeInvalidPath:
+			c.handleInvalidPath(wrapper)
+		case common.TypeRenameRejected:
+			c.handleRenameRejected(wrapper)
 		default:
 			log.Warn().Str("type", string(wrapper.Type)).Msg("Received unknown message type from server")
 		}
-		c.setSyncing(false)
 	}
 }
 
-func (c *Client) handleManifest(payload []byte) {
+func (c *Client) handleManifest(wrapper common.MessageWrapper) {
 	var msg common.ManifestMessage
-	if err := json.Unmarshal(payload, &msg); err != nil {
+	if err := common.DecodePayload(wrapper, &msg); err != nil {
 		log.Error().Err(err).Msg("Failed to unmarshal manifest")
 		return
 	}
 	log.Info().Msg("Received server manifest. Starting initial sync.")
-	localManifest, err := common.BuildFileManifest(c.cfg.SyncDir, c.ignorer)
+	c.advance(msg.Seq)
+	local, err := common.BuildFileManifest(c.cfg.SyncDir, c.ignorer, c.symlinks, c.index)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to build local manifest for sync")
 		return
 	}
+	c.syncManifest(msg, local)
+}
+
+// syncManifest brings the local directory and the server in line with each other
+func (c *Client) syncManifest(msg, local common.ManifestMessage) {
+	serverStates := msg.States()
+	for path := range serverStates {
+		if !c.checkPath(path) {
+			delete(serverStates, path)
+		}
+	}
 	var toRequest []string
-	serverFiles := make(map[string]bool)
+	if !c.journal.Exists() {
+		// Nothing has been synced before, so the server is the source of truth
+		toRequest = c.adoptServerManifest(serverStates, local.States())
+	} else {
+		toRequest = c.reconcileManifest(serverStates, local.States())
+	}
+	c.adoptServerMeta(&msg, &local)
+	if err := c.journal.Save(); err != nil {
+		log.Error().Err(err).Msg("Failed to save sync journal")
+	}
+	if len(toRequest) > 0 {
+		log.Info().Int("count", len(toRequest)).Msg("Requesting files from server")
+		c.requestFiles(toRequest)
+	} else {
+		log.Info().Msg("Initial sync complete. Local directory is up-to-date.")
+	}
+	c.resumable = c.hasCapability(common.CapOpLog)
+	c.setState(stateLive)
+}
 
-	// Compare server manifest with local manifest
-	for path, serverHash := range msg.Files {
-		serverFiles[path] = true
+func (c *Client) adoptServerManifest(serverManifest, localManifest map[string]string) []string {
+	var toRequest []string
+	for path, serverHash := range serverManifest {
 		localHash, exists := localManifest[path]
 		if !exists || localHash != serverHash {
-			toRequest = append(toRequest, path)
+			toRequest = c.pull(path, serverHash, toRequest)
+		} else {
+			c.journal.Set(path, serverHash)
+		}
+	}
+	// Remove local files not on server, then the directories they leave empty, deepest first
+	var staleDirs []string
+	for path, localHash := range localManifest {
+		if _, exists := serverManifest[path]; exists {
+			continue
 		}
+		if localHash == common.StateDir {
+			staleDirs = append(staleDirs, path)
+		} else {
+			c.removeLocal(path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(staleDirs)))
+	for _, dir := range staleDirs {
+		c.removeEmptyDir(dir)
 	}
+	return toRequest
+}
+
+// pull fetches a path that changed on the server: directories are created right away, anything
+// else is added to toRequest
+func (c *Client) pull(path, serverState string, toRequest []string) []string {
+	if serverState != common.StateDir {
+		return append(toRequest, path)
+	}
+	c.makeLocalDir(path, common.FileMeta{})
+	return toRequest
+}
 
-	// Remove local files not on server
+// reconcileManifest compares local and server state against the journal so only the side
+// that changed since the last sync is propagated
+func (c *Client) reconcileManifest(serverManifest, localManifest map[string]string) []string {
+	var toRequest, staleDirs []string
+	paths := c.journal.Snapshot()
+	for path := range serverManifest {
+		paths[path] = ""
+	}
 	for path := range localManifest {
-		if !serverFiles[path] {
-			fullPath := filepath.Join(c.cfg.SyncDir, path)
-			log.Info().Str("path", path).Msg("Removing local file not present on server")
-			if err := os.RemoveAll(fullPath); err != nil {
-				log.Error().Err(err).Str("path", fullPath).Msg("Failed to remove local file")
+		paths[path] = ""
+	}
+	for path := range paths {
+		if c.isReplayed(path) {
+			continue
+		}
+		serverHash, onServer := serverManifest[path]
+		localHash, onLocal := localManifest[path]
+		syncedHash, synced := c.journal.Get(path)
+		if onServer && onLocal && serverHash == localHash {
+			if c.uploading(path) {
+				// Resuming fills in the server's side from the local one, which may not have been sent yet
+				log.Info().Str("path", path).Msg("Pushing change still on its way to server")
+				c.push(path, localHash)
+				continue
 			}
+			c.journal.Set(path, serverHash)
+			continue
+		}
+		if !onServer && !onLocal {
+			c.journal.DeleteTree(path)
+			continue
+		}
+		if c.ignorer.IsIgnored(path) {
+			// Local changes to ignored paths are never sent, so the server copy always wins
+			if onServer {
+				toRequest = c.pull(path, serverHash, toRequest)
+			}
+			continue
+		}
+		localChanged := onLocal != synced || localHash != syncedHash
+		serverChanged := onServer != synced || serverHash != syncedHash
+		switch {
+		case localChanged && !serverChanged:
+			log.Info().Str("path", path).Msg("Pushing change made while offline")
+			c.push(path, localHash)
+		case !localChanged && serverChanged:
+			switch {
+			case onServer:
+				toRequest = c.pull(path, serverHash, toRequest)
+			case localHash == common.StateDir:
+				staleDirs = append(staleDirs, path)
+			default:
+				c.removeLocal(path)
+			}
+		default:
+			// The server compares the journal base against its own state and keeps both versions
+			log.Warn().Str("path", path).Msg("File changed both locally and on server while offline, sending local version for conflict resolution")
+			c.push(path, localHash)
 		}
 	}
-	if len(toRequest) > 0 {
-		log.Info().Int("count", len(toRequest)).Msg("Requesting files from server")
-		c.requestFiles(toRequest)
-	} else {
-		log.Info().Msg("Initial sync complete. Local directory is up-to-date.")
+	// Directories go once the files in them are gone, deepest first. One still holding something
+	// created while offline is kept and sent back to the server with its new contents.
+	sort.Sort(sort.Reverse(sort.StringSlice(staleDirs)))
+	for _, dir := range staleDirs {
+		if !c.removeEmptyDir(dir) {
+			log.Info().Str("path", dir).Msg("Pushing directory removed on server with contents added while offline")
+			c.push(dir, common.StateDir)
+		}
 	}
+	return toRequest
 }
 
-func (c *Client) handleFileContent(payload []byte) {
+func (c *Client) removeLocal(path string) {
+	fullPath := filepath.Join(c.cfg.SyncDir, path)
+	log.Info().Str("path", path).Msg("Removing local file not present on server")
+	c.expected.Set(path, common.StateRemoved)
+	if err := os.RemoveAll(fullPath); err != nil {
+		log.Error().Err(err).Str("path", fullPath).Msg("Failed to remove local file")
+		return
+	}
+	c.journal.DeleteTree(path)
+}
+
+// removeEmptyDir removes a local directory not present on the server, unless something the
+// server doesn't know about, like ignored files, is still inside. It reports whether it was removed.
+func (c *Client) removeEmptyDir(path string) bool {
+	c.expected.Set(path, common.StateRemoved)
+	if err := os.Remove(filepath.Join(c.cfg.SyncDir, path)); err != nil {
+		log.Debug().Err(err).Str("path", path).Msg("Keeping local directory not present on server")
+		c.expected.Set(path, common.StateDir)
+		return false
+	}
+	log.Info().Str("path", path).Msg("Removed local directory not present on server")
+	c.journal.DeleteTree(path)
+	return true
+}
+
+// makeLocalDir creates a directory from the server and records it in the journal
+func (c *Client) makeLocalDir(path string, meta common.FileMeta) {
+	c.expected.ExpectParents(c.cfg.SyncDir, path)
+	c.expected.Set(path, common.StateDir)
+	if err := os.MkdirAll(filepath.Join(c.cfg.SyncDir, path), 0755); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Failed to create directory")
+		return
+	}
+	if meta.Mode != 0 {
+		c.applyMeta(path, meta)
+	}
+	c.journal.Set(path, common.StateDir)
+	c.trackSynced(path)
+}
+
+// pushLocalState sends the current local state of path to the server as an operation
+func (c *Client) pushLocalState(path string) {
+	info, err := c.symlinks.Stat(filepath.Join(c.cfg.SyncDir, path))
+	if os.IsNotExist(err) || errors.Is(err, common.ErrSymlinkSkipped) {
+		c.sendOperation(common.FileOperationMessage{Path: path, Op: common.OpRemove})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Failed to stat file for sending")
+		return
+	}
+	if info.IsDir() {
+		c.pushTree(path)
+		return
+	}
+	c.sendFile(path, info)
+}
+
+// push sends the local state of a manifest entry; directories go without their contents, which
+// have entries of their own
+func (c *Client) push(path, localState string) {
+	if localState != common.StateDir {
+		c.pushLocalState(path)
+		return
+	}
+	info, err := os.Stat(filepath.Join(c.cfg.SyncDir, path))
+	if err != nil {
+		c.pushLocalState(path)
+		return
+	}
+	c.sendOperation(common.FileOperationMessage{Op: common.OpWrite, Path: path, IsDir: true, FileMeta: common.MetaOf(info)})
+}
+
+// pushTree sends a local directory and everything below it to the server
+func (c *Client) pushTree(path string) {
+	c.symlinks.Walk(filepath.Join(c.cfg.SyncDir, path), func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		relPath, err := filepath.Rel(c.cfg.SyncDir, fullPath)
+		if err != nil || c.ignorer.IsIgnored(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			c.sendOperation(common.FileOperationMessage{Op: common.OpWrite, Path: relPath, IsDir: true, FileMeta: common.MetaOf(info)})
+		} else {
+			c.sendFile(relPath, info)
+		}
+		return nil
+	})
+}
+
+// pushNewTree sends what is already inside a directory that appeared locally
+func (c *Client) pushNewTree(path string) {
+	common.WalkNewTree(c.cfg.SyncDir, path, c.symlinks, c.ignorer, c.index, c.expected, func(relPath, fullPath string, info os.FileInfo) {
+		log.Info().Str("op", string(common.OpWrite)).Str("path", relPath).Msg("Found entry in new directory, sending to server")
+		if info.IsDir() {
+			c.sendOperation(common.FileOperationMessage{Op: common.OpWrite, Path: relPath, IsDir: true, FileMeta: common.MetaOf(info)})
+		} else {
+			c.sendFile(relPath, info)
+		}
+	})
+}
+
+// sendFile uploads a local file, as a delta when the server likely holds an older copy
+func (c *Client) sendFile(path string, info os.FileInfo) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		c.sendLink(path)
+		return
+	}
+	if _, synced := c.journal.Get(path); synced && info.Size() >= common.MinDeltaSize && c.hasCapability(common.CapDelta) {
+		c.requestSignature(path)
+		return
+	}
+	c.sendFullFile(path, info)
+}
+
+// sendFullFile uploads the whole content of a local file, streaming it in chunks when large
+func (c *Client) sendFullFile(path string, info os.FileInfo) {
+	if info.Size() >= common.StreamThreshold && c.hasCapability(common.CapChunked) {
+		c.streamFile(path, info)
+		return
+	}
+	content, err := os.ReadFile(filepath.Join(c.cfg.SyncDir, path))
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Failed to read file for sending")
+		return
+	}
+	c.sendOperation(common.FileOperationMessage{Op: common.OpWrite, Path: path, Content: content, FileMeta: common.MetaOf(info)})
+}
+
+func (c *Client) handleFileContent(wrapper common.MessageWrapper) {
 	var msg common.FileContentMessage
-	if err := json.Unmarshal(payload, &msg); err != nil {
+	if err := common.DecodePayload(wrapper, &msg); err != nil {
 		log.Error().Err(err).Msg("Failed to unmarshal file content")
 		return
 	}
+	if !c.checkPath(msg.Path) {
+		return
+	}
 	log.Info().Str("path", msg.Path).Msg("Received file content from server")
-	fullPath := filepath.Join(c.cfg.SyncDir, msg.Path)
-	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-		log.Error().Err(err).Str("path", fullPath).Msg("Failed to create parent directories")
+	c.writeLocalFile(&common.FileOperationMessage{
+		Op:         common.OpWrite,
+		Path:       msg.Path,
+		Content:    msg.Content,
+		Delta:      msg.Delta,
+		DeltaBase:  msg.DeltaBase,
+		BlockSize:  msg.BlockSize,
+		Hash:       msg.Hash,
+		LinkTarget: msg.LinkTarget,
+		FileMeta:   msg.FileMeta,
+	})
+}
+
+// writeLocalFile writes the content of a write operation from the server and records it in the journal
+func (c *Client) writeLocalFile(op *common.FileOperationMessage) {
+	delete(c.requested, op.Path)
+	if op.LinkTarget != "" {
+		c.writeLocalLink(op)
 		return
 	}
-	if err := os.WriteFile(fullPath, msg.Content, 0644); err != nil {
-		log.Error().Err(err).Str("path", msg.Path).Msg("Failed to write file")
+	if op.Delta != nil && !c.expandDelta(op) {
+		return
+	}
+	fullPath := filepath.Join(c.cfg.SyncDir, op.Path)
+	c.expected.ExpectParents(c.cfg.SyncDir, op.Path)
+	c.expected.Set(op.Path, op.ContentHash())
+	perm := op.Perm(fullPath)
+	c.expected.SetMode(op.Path, uint32(perm))
+	if op.ContentPath != "" {
+		if err := common.PlaceFile(op.ContentPath, fullPath, perm); err != nil {
+			log.Error().Err(err).Str("path", op.Path).Msg("Failed to move received file into place")
+			os.Remove(op.ContentPath)
+			return
+		}
+	} else {
+		if err := common.WriteFileAtomic(fullPath, op.Content, perm); err != nil {
+			log.Error().Err(err).Str("path", op.Path).Msg("Failed to write file")
+			return
+		}
+	}
+	if err := op.FileMeta.Apply(fullPath); err != nil {
+		log.Error().Err(err).Str("path", op.Path).Msg("Failed to apply file metadata")
 	}
+	c.journal.Set(op.Path, op.ContentHash())
+	c.trackSynced(op.Path)
 }
 
-func (c *Client) handleFileOperation(payload []byte) {
+func (c *Client) handleFileOperation(wrapper common.MessageWrapper) {
 	var op common.FileOperationMessage
-	if err := json.Unmarshal(payload, &op); err != nil {
+	if err := common.DecodePayload(wrapper, &op); err != nil {
 		log.Error().Err(err).Msg("Failed to unmarshal file operation")
 		return
 	}
+	if !c.checkPath(op.Path) {
+		return
+	}
 	log.Info().Str("op", string(op.Op)).Str("path", op.Path).Msg("Received file operation from server")
+	c.advance(op.Seq)
 	fullPath := filepath.Join(c.cfg.SyncDir, op.Path)
 
 	switch op.Op {
 	case common.OpWrite:
 		if op.IsDir {
-			if err := os.MkdirAll(fullPath, 0755); err != nil {
-				log.Error().Err(err).Str("path", op.Path).Msg("Failed to create directory from operation")
-			}
-			return
-		}
-		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-			log.Error().Err(err).Msg("Failed to create parent directories")
+			c.makeLocalDir(op.Path, op.FileMeta)
 			return
 		}
-		if err := os.WriteFile(fullPath, op.Content, 0644); err != nil {
-			log.Error().Err(err).Str("path", op.Path).Msg("Failed to write file from operation")
-		}
+		c.writeLocalFile(&op)
+	case common.OpMeta:
+		c.applyMeta(op.Path, op.FileMeta)
+	case common.OpRename:
+		c.applyRename(&op)
 	case common.OpRemove:
+		c.expected.Set(op.Path, common.StateRemoved)
 		if err := os.RemoveAll(fullPath); err != nil {
 			log.Error().Err(err).Str("path", fullPath).Msg("Failed to remove file from operation")
+			return
 		}
+		c.journal.DeleteTree(op.Path)
 	}
 }
 
 func (c *Client) requestFiles(paths []string) {
-	payload, _ := json.Marshal(common.FileRequestMessage{Paths: paths})
-	msg := common.MessageWrapper{
-		Type:    common.TypeFileRequest,
-		Payload: payload,
+	for _, path := range paths {
+		c.requested[path] = true
 	}
-	c.sendMessage(msg)
+	req := common.FileRequestMessage{Paths: paths}
+	if c.hasCapability(common.CapDelta) {
+		req.Signatures = c.localSignatures(paths)
+	}
+	c.sendMessage(common.TypeFileRequest, req)
 }
 
 func (c *Client) watchFilesystem() {
 	// Add all subdirectories to the watcher
-	filepath.Walk(c.cfg.SyncDir, func(path string, info os.FileInfo, err error) error {
-		if info != nil && info.IsDir() {
-			relPath, _ := filepath.Rel(c.cfg.SyncDir, path)
-			if !c.ignorer.IsIgnored(relPath) {
-				if err := c.watcher.Add(path); err != nil {
-					log.Error().Err(err).Str("path", path).Msg("Failed to add path to watcher")
-				}
-			}
-		}
-		return nil
-	})
+	common.WatchTree(c.watcher, c.symlinks, c.cfg.SyncDir, c.watchable)
+	events := common.NewDebouncer()
+	ticker := time.NewTicker(common.SettleDelay / 4)
+	defer ticker.Stop()
 	for {
 		select {
 		case event, ok := <-c.watcher.Events:
 			if !ok {
 				return
 			}
-			if c.isSyncing {
-				continue // Ignore events generated by own sync
+			if c.isDirEvent(event) {
+				// Directories are handled right away so they are watched before files appear in them
+				c.handleFsEvent(event)
+				continue
+			}
+			events.Add(event, time.Now())
+		case <-ticker.C:
+			for _, event := range events.Settled(time.Now()) {
+				c.handleFsEvent(event)
 			}
-			c.handleFsEvent(event)
 		case err, ok := <-c.watcher.Errors:
 			if !ok {
 				return
@@ -237,56 +704,163 @@ func (c *Client) handleFsEvent(event fsnotify.Event) {
 	if err != nil || c.ignorer.IsIgnored(relPath) {
 		return
 	}
-	op := common.FileOperationMessage{Path: relPath}
-	if event.Op&fsnotify.Remove == fsnotify.Remove || event.Op&fsnotify.Rename == fsnotify.Rename {
-		op.Op = common.OpRemove
-		c.watcher.Remove(event.Name) // Stop watching removed files/dirs
-	} else if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-		info, err := os.Stat(event.Name)
-		if err != nil {
-			// File may have been removed quickly, ignore error
-			return
+	if filepath.Base(relPath) == common.IgnoreFileName {
+		c.ignorer.Reload(relPath)
+	}
+	info, err := c.symlinks.Stat(event.Name)
+	if os.IsNotExist(err) {
+		c.handleLocalRemoval(relPath, event)
+		return
+	}
+	if err != nil {
+		return
+	}
+	created := event.Op&fsnotify.Create == fsnotify.Create
+	if !created && event.Op&fsnotify.Write == 0 {
+		if event.Op&fsnotify.Chmod != 0 && info.Mode()&os.ModeSymlink == 0 {
+			c.sendMeta(relPath, info)
 		}
-		op.Op = common.OpWrite
+		return
+	}
+	if info.IsDir() && !created {
+		return
+	}
+	state, err := c.index.State(event.Name, info)
+	if err != nil {
+		// File may have been removed quickly, ignore error
+		return
+	}
+	if c.expected.Matches(relPath, state) {
+		log.Debug().Str("path", relPath).Msg("Suppressing watcher event for own write")
 		if info.IsDir() {
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				c.watcher.Add(event.Name)
-				op.IsDir = true
-			} else {
-				return
-			}
-		} else {
-			content, err := os.ReadFile(event.Name)
-			if err != nil {
-				log.Error().Err(err).Str("path", event.Name).Msg("Failed to read file for sending")
-				return
-			}
-			op.Content = content
+			common.WatchTree(c.watcher, c.symlinks, event.Name, c.watchable)
 		}
-	} else {
+		c.rememberInode(relPath, info)
+		return
+	}
+	c.expected.Set(relPath, state)
+	c.expected.SetMode(relPath, common.MetaOf(info).Mode)
+	if created {
+		if oldPath, ok := c.matchRename(relPath, info); ok {
+			c.sendRename(oldPath, relPath, info.IsDir())
+			return
+		}
+	}
+	c.rememberInode(relPath, info)
+	log.Info().Str("op", string(common.OpWrite)).Str("path", relPath).Msg("Detected local change, sending to server")
+	if !info.IsDir() {
+		c.sendFile(relPath, info)
+		return
+	}
+	common.WatchTree(c.watcher, c.symlinks, event.Name, c.watchable)
+	c.sendOperation(common.FileOperationMessage{Op: common.OpWrite, Path: relPath, IsDir: true, FileMeta: common.MetaOf(info)})
+	c.pushNewTree(relPath)
+}
+
+// handleLocalRemoval propagates a path that disappeared, unless the sync engine removed it
+func (c *Client) handleLocalRemoval(relPath string, event fsnotify.Event) {
+	c.index.DeleteTree(relPath)
+	if c.expected.Matches(relPath, common.StateRemoved) || c.expected.ParentRemoved(relPath) {
+		log.Debug().Str("path", relPath).Msg("Suppressing watcher event for own removal")
+		common.UnwatchTree(c.watcher, event.Name)
+		c.moveInodes(relPath, "")
+		return
+	}
+	if event.Op&fsnotify.Rename == fsnotify.Rename {
+		// Paired with the create event of the new name, if it is inside the sync directory
+		c.deferRemoval(relPath)
+		return
+	}
+	c.sendRemoval(relPath)
+}
+
+// sendOperation sends a local change and records it in the journal once the server applied it,
+// or right away for servers that don't acknowledge operations
+func (c *Client) sendOperation(op common.FileOperationMessage) {
+	c.setBaseHash(&op)
+	c.track(&op)
+	if err := c.sendMessage(common.TypeFileOperation, op); err != nil {
+		c.untrack(op.ID)
+		c.queueChange(outboxEntry{Op: op.Op, Path: op.Path, NewPath: op.NewPath, IsDir: op.IsDir, BaseHash: op.BaseHash})
+		return
+	}
+	if op.ID != "" {
+		return
+	}
+	switch {
+	case op.Op == common.OpRemove:
+		c.journal.DeleteTree(op.Path)
+	case op.Op == common.OpRename:
+		c.journal.MoveTree(op.Path, op.NewPath)
+	case op.Op == common.OpWrite:
+		c.journal.Set(op.Path, op.ContentHash())
+	}
+}
+
+// setBaseHash attaches the state the server holds for the path for conflict detection: the base
+// of a change being sent again, or the journal's last-synced state with unanswered changes on top
+func (c *Client) setBaseHash(op *common.FileOperationMessage) {
+	pinned, isPinned := c.unacked.takePin(op.Path)
+	if op.IsDir || op.Op == common.OpMeta {
+		return
+	}
+	if isPinned {
+		op.BaseHash = pinned
 		return
 	}
-	log.Info().Str("op", string(op.Op)).Str("path", relPath).Msg("Detected local change, sending to server")
-	payload, _ := json.Marshal(op)
-	msg := common.MessageWrapper{
-		Type:    common.TypeFileOperation,
-		Payload: payload,
+	base, synced := c.syncedState(op.Path)
+	// A removed path the journal doesn't know may be a directory, so it has no base
+	if synced || op.Op == common.OpWrite {
+		op.BaseHash = &base
 	}
-	c.sendMessage(msg)
 }
 
-func (c *Client) sendMessage(message common.MessageWrapper) {
+func (c *Client) sendMessage(msgType common.MessageType, payload any) error {
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
-	if c.conn != nil {
-		if err := c.conn.WriteJSON(message); err != nil {
-			log.Error().Err(err).Msg("Failed to send message to server")
-		}
+	if c.conn == nil {
+		return errNotConnected
+	}
+	frameType, data, err := c.codec.Encode(msgType, payload)
+	if err != nil {
+		return err
+	}
+	if err := c.conn.WriteMessage(frameType, data); err != nil {
+		log.Error().Err(err).Msg("Failed to send message to server")
+		return err
 	}
+	return nil
 }
 
-func (c *Client) setSyncing(status bool) {
-	c.syncingMutex.Lock()
-	defer c.syncingMutex.Unlock()
-	c.isSyncing = status
+func (c *Client) flushJournal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.journal.Flush(); err != nil {
+				log.Error().Err(err).Msg("Failed to save sync journal")
+			}
+			if err := c.index.Flush(); err != nil {
+				log.Error().Err(err).Msg("Failed to save file index")
+			}
+			if err := c.outbox.Flush(); err != nil {
+				log.Error().Err(err).Msg("Failed to save outgoing queue")
+			}
+		case sig := <-signals:
+			log.Info().Str("signal", sig.String()).Msg("Shutting down, saving sync journal")
+			if err := c.journal.Flush(); err != nil {
+				log.Error().Err(err).Msg("Failed to save sync journal")
+			}
+			if err := c.index.Flush(); err != nil {
+				log.Error().Err(err).Msg("Failed to save file index")
+			}
+			if err := c.outbox.Flush(); err != nil {
+				log.Error().Err(err).Msg("Failed to save outgoing queue")
+			}
+			os.Exit(0)
+		}
+	}
 }
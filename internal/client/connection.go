@@ -0,0 +1,69 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrRetriesExhausted is returned by Run when MaxRetries reconnects in a row failed
+var ErrRetriesExhausted = errors.New("gave up reconnecting to server")
+
+const (
+	defaultRetryMin = time.Second
+	defaultRetryMax = time.Minute
+)
+
+// connState is where the client is in its connection lifecycle
+type connState int32
+
+const (
+	// stateConnecting dials the server and runs the handshake
+	stateConnecting connState = iota
+	// stateSyncing runs the initial sync against the server manifest
+	stateSyncing
+	// stateLive exchanges changes in real time
+	stateLive
+	// stateBackoff waits before the next connection attempt
+	stateBackoff
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateConnecting:
+		return "connecting"
+	case stateSyncing:
+		return "syncing"
+	case stateLive:
+		return "live"
+	case stateBackoff:
+		return "backoff"
+	}
+	return "unknown"
+}
+
+func (c *Client) setState(state connState) {
+	if old := connState(c.state.Swap(int32(state))); old != state {
+		log.Debug().Stringer("from", old).Stringer("to", state).Msg("Connection state changed")
+	}
+}
+
+func (c *Client) currentState() connState {
+	return connState(c.state.Load())
+}
+
+// backoff sleeps before reconnect attempt n (from 1), doubling the delay with every attempt up
+// to RetryMax. Half of it is random, so clients disconnected by the same outage spread out.
+func (c *Client) backoff(attempt int) {
+	c.setState(stateBackoff)
+	delay := c.cfg.RetryMin
+	for i := 1; i < attempt && delay < c.cfg.RetryMax; i++ {
+		delay *= 2
+	}
+	delay = min(delay, c.cfg.RetryMax)
+	delay = delay/2 + rand.N(delay/2+1)
+	log.Info().Int("attempt", attempt).Dur("delay", delay).Msg("Reconnecting after backoff")
+	time.Sleep(delay)
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// requestSignature starts a delta upload by asking the server for the signature of its copy of path
+func (c *Client) requestSignature(path string) {
+	c.awaitSignature(path)
+	if err := c.sendMessage(common.TypeSignatureRequest, common.SignatureRequestMessage{Path: path}); err != nil {
+		c.signed(path)
+		c.queueChange(outboxEntry{Op: common.OpWrite, Path: path})
+	}
+}
+
+// handleSignature finishes a delta upload by sending the local file as a delta against the server's copy
+func (c *Client) handleSignature(wrapper common.MessageWrapper) {
+	var msg common.SignatureMessage
+	if err := common.DecodePayload(wrapper, &msg); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal signature")
+		return
+	}
+	if !c.checkPath(msg.Path) {
+		return
+	}
+	defer c.signed(msg.Path)
+	if msg.ID != "" {
+		log.Debug().Str("path", msg.Path).Msg("Delta base was stale on server, sending again")
+		c.replace(msg.ID)
+	}
+	fullPath := filepath.Join(c.cfg.SyncDir, msg.Path)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		// Removed in the meantime, the removal is sent separately
+		return
+	}
+	if msg.Signature != nil {
+		if op, ok := c.localDelta(msg.Path, msg.Signature, info.Size()); ok {
+			op.FileMeta = common.MetaOf(info)
+			log.Debug().Str("path", msg.Path).Int("ops", len(op.Delta)).Msg("Sending file as delta")
+			c.sendOperation(op)
+			return
+		}
+	}
+	c.sendFullFile(msg.Path, info)
+}
+
+func (c *Client) localDelta(path string, sig *common.Signature, size int64) (common.FileOperationMessage, bool) {
+	op := common.FileOperationMessage{Op: common.OpWrite, Path: path, DeltaBase: sig.Hash, BlockSize: sig.BlockSize}
+	file, err := os.Open(filepath.Join(c.cfg.SyncDir, path))
+	if err != nil {
+		return op, false
+	}
+	defer file.Close()
+	hash := sha256.New()
+	delta, err := common.ComputeDelta(sig, io.TeeReader(file, hash), common.MaxDeltaLiteral(size))
+	if err != nil {
+		if !errors.Is(err, common.ErrDeltaTooLarge) {
+			log.Error().Err(err).Str("path", path).Msg("Failed to compute delta, sending full content")
+		}
+		return op, false
+	}
+	op.Delta = delta
+	op.Hash = hex.EncodeToString(hash.Sum(nil))
+	return op, true
+}
+
+// expandDelta rebuilds the content of a delta write from the local copy into op.ContentPath. When
+// the local copy is not the expected base, the file is requested again and false is returned.
+func (c *Client) expandDelta(op *common.FileOperationMessage) bool {
+	fullPath := filepath.Join(c.cfg.SyncDir, op.Path)
+	if hash, err := common.ComputeFileHash(fullPath); err != nil || hash != op.DeltaBase {
+		log.Warn().Str("path", op.Path).Msg("Local file does not match delta base, requesting it again")
+		c.requestFiles([]string{op.Path})
+		return false
+	}
+	tmpPath, err := common.ApplyDeltaFile(fullPath, op.BlockSize, op.Delta, c.cfg.SyncDir, op.Hash)
+	if err != nil {
+		log.Error().Err(err).Str("path", op.Path).Msg("Failed to apply delta, requesting file again")
+		c.requestFiles([]string{op.Path})
+		return false
+	}
+	op.ContentPath = tmpPath
+	return true
+}
+
+// localSignatures returns signatures of the local copies of paths large enough for a delta
+func (c *Client) localSignatures(paths []string) map[string]*common.Signature {
+	signatures := make(map[string]*common.Signature)
+	for _, path := range paths {
+		fullPath := filepath.Join(c.cfg.SyncDir, path)
+		info, err := c.symlinks.Stat(fullPath)
+		if err != nil || !info.Mode().IsRegular() || info.Size() < common.MinDeltaSize {
+			continue
+		}
+		sig, err := common.FileSignature(fullPath)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Failed to compute file signature")
+			continue
+		}
+		signatures[path] = sig
+	}
+	return signatures
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// errRejected means the server refused this client, so reconnecting is pointless
+var errRejected = errors.New("rejected by server")
+
+// handshake negotiates the protocol version and capabilities with the server
+func (c *Client) handshake(conn *websocket.Conn, codec common.Codec) (common.Capabilities, error) {
+	if conn.Subprotocol() == "" {
+		// Servers from before the handshake existed negotiate no subprotocol and never send welcome
+		log.Warn().Msg("Server predates the protocol handshake, using legacy protocol without optional features")
+		return nil, nil
+	}
+	frameType, data, err := codec.Encode(common.TypeHello, common.HelloMessage{
+		ProtocolVersion:    common.ProtocolVersion,
+		MinProtocolVersion: common.MinProtocolVersion,
+		Version:            common.Version,
+		Capabilities:       common.Capabilities(common.SupportedCapabilities).ForSymlinks(c.symlinks.Mode),
+		Resume:             c.resumePoint(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(frameType, data); err != nil {
+		return nil, fmt.Errorf("failed to send hello: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	frameType, data, err = conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read welcome: %w", err)
+	}
+	wrapper, err := codec.Decode(frameType, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode welcome: %w", err)
+	}
+	switch wrapper.Type {
+	case common.TypeWelcome:
+		var welcome common.WelcomeMessage
+		if err := common.DecodePayload(wrapper, &welcome); err != nil {
+			return nil, fmt.Errorf("malformed welcome: %w", err)
+		}
+		caps := common.NegotiateCapabilities(welcome.Capabilities)
+		if caps.Has(common.CapCompression) {
+			conn.EnableWriteCompression(true)
+		}
+		if caps.Has(common.CapOpLog) && welcome.Epoch != c.epoch {
+			// A new epoch restarts the sequence, so nothing from the old one carries over
+			c.epoch = welcome.Epoch
+			c.seq = 0
+		}
+		log.Info().Int("protocol", welcome.ProtocolVersion).Str("server_version", welcome.Version).Interface("capabilities", caps).Str("client_id", welcome.ClientID).Msg("Handshake complete")
+		return caps, nil
+	case common.TypeReject:
+		var reject common.RejectMessage
+		common.DecodePayload(wrapper, &reject)
+		return nil, fmt.Errorf("%w: %s", errRejected, reject.Reason)
+	default:
+		return nil, fmt.Errorf("unexpected %q message during handshake", wrapper.Type)
+	}
+}
+
+// hasCapability reports whether the current session negotiated capability
+func (c *Client) hasCapability(capability common.Capability) bool {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.caps.Has(capability)
+}
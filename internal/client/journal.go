@@ -0,0 +1,137 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+const journalFileName = "journal.json"
+
+// journal persists the hash of every file as of its last successful sync, which lets
+// reconnects tell local edits made while offline apart from changes made on the server
+type journal struct {
+	mu     sync.Mutex
+	path   string
+	Files  map[string]string `json:"files"`
+	exists bool
+	dirty  bool
+}
+
+func loadJournal(syncDir string) (*journal, error) {
+	j := &journal{
+		path:  filepath.Join(syncDir, common.StateDirName, journalFileName),
+		Files: make(map[string]string),
+	}
+	data, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync journal: %w", err)
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("failed to parse sync journal: %w", err)
+	}
+	if j.Files == nil {
+		j.Files = make(map[string]string)
+	}
+	j.exists = true
+	return j, nil
+}
+
+// Exists reports whether a previous sync has been recorded
+func (j *journal) Exists() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.exists
+}
+
+func (j *journal) Get(path string) (string, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	hash, ok := j.Files[path]
+	return hash, ok
+}
+
+func (j *journal) Snapshot() map[string]string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	snapshot := make(map[string]string, len(j.Files))
+	for path, hash := range j.Files {
+		snapshot[path] = hash
+	}
+	return snapshot
+}
+
+func (j *journal) Set(path, hash string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Files[path] = hash
+	j.dirty = true
+}
+
+// DeleteTree forgets path and, if it was a directory, everything below it
+func (j *journal) DeleteTree(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	prefix := path + string(filepath.Separator)
+	for p := range j.Files {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(j.Files, p)
+			j.dirty = true
+		}
+	}
+}
+
+// MoveTree re-keys path and everything below it to newPath
+func (j *journal) MoveTree(path, newPath string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	moved := make(map[string]string)
+	for p, hash := range j.Files {
+		if target, ok := common.RebasePath(p, path, newPath); ok {
+			delete(j.Files, p)
+			moved[target] = hash
+		}
+	}
+	for p, hash := range moved {
+		j.Files[p] = hash
+		j.dirty = true
+	}
+}
+
+// Flush saves the journal if it changed since the last save and a sync has been recorded
+func (j *journal) Flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.dirty || !j.exists {
+		return nil
+	}
+	return j.save()
+}
+
+// Save records a completed sync and writes the journal to disk
+func (j *journal) Save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.save()
+}
+
+func (j *journal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err := common.WriteFileAtomic(j.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write sync journal: %w", err)
+	}
+	j.exists = true
+	j.dirty = false
+	return nil
+}
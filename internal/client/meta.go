@@ -0,0 +1,52 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// sendMeta propagates a local permission change; other attribute changes like touched times are not sent on their own
+func (c *Client) sendMeta(relPath string, info os.FileInfo) {
+	meta := common.MetaOf(info)
+	if c.expected.ModeMatches(relPath, meta.Mode) {
+		return
+	}
+	c.expected.SetMode(relPath, meta.Mode)
+	if !c.hasCapability(common.CapMetadata) {
+		log.Debug().Str("path", relPath).Msg("Server does not sync metadata, permission change not sent")
+		return
+	}
+	log.Info().Str("op", string(common.OpMeta)).Str("path", relPath).Msg("Detected local change, sending to server")
+	c.sendOperation(common.FileOperationMessage{Op: common.OpMeta, Path: relPath, IsDir: info.IsDir(), FileMeta: meta})
+}
+
+// adoptServerMeta gives files whose content already matches the server the server's metadata;
+// files that are fetched or pushed carry their metadata with the content
+func (c *Client) adoptServerMeta(msg, local *common.ManifestMessage) {
+	for path, meta := range msg.Meta {
+		if c.isReplayed(path) {
+			continue
+		}
+		if hash, ok := local.Files[path]; ok && hash == msg.Files[path] && meta.Differs(local.Meta[path]) {
+			c.applyMeta(path, meta)
+		}
+	}
+}
+
+// applyMeta sets metadata from the server on a local path
+func (c *Client) applyMeta(path string, meta common.FileMeta) {
+	fullPath := filepath.Join(c.cfg.SyncDir, path)
+	// Changing times is reported as a write, which has to be recognized as our own
+	if state, err := c.symlinks.State(fullPath); err == nil {
+		c.expected.Set(path, state)
+	}
+	if meta.Mode != 0 {
+		c.expected.SetMode(path, meta.Mode)
+	}
+	if err := meta.Apply(fullPath); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Failed to apply file metadata")
+	}
+}
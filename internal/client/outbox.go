@@ -0,0 +1,233 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+const outboxFileName = "outbox.json"
+
+// outboxEntry is a local change that could not be sent. Content is read from disk when it is
+// replayed, so only the kind of change is recorded.
+type outboxEntry struct {
+	Op      common.OperationType `json:"op"`
+	Path    string               `json:"path"`
+	NewPath string               `json:"new_path,omitempty"`
+	IsDir   bool                 `json:"is_dir,omitempty"`
+	// BaseHash is the base the change was first sent with, kept as the journal only moves on acks
+	BaseHash *string `json:"base_hash,omitempty"`
+}
+
+// outbox persists the local changes made while disconnected, in order and compacted per path,
+// so they are replayed once the client reconnects
+type outbox struct {
+	mu      sync.Mutex
+	path    string
+	Entries []outboxEntry `json:"entries"`
+	dirty   bool
+}
+
+func loadOutbox(syncDir string) (*outbox, error) {
+	o := &outbox{path: filepath.Join(syncDir, common.StateDirName, outboxFileName)}
+	data, err := os.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outgoing queue: %w", err)
+	}
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, fmt.Errorf("failed to parse outgoing queue: %w", err)
+	}
+	return o, nil
+}
+
+// Add queues a change, replacing the queued changes it supersedes. Renames are kept in order, so
+// entries queued before a rename involving the same paths are left alone.
+func (o *outbox) Add(entry outboxEntry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.dirty = true
+	if entry.Op == common.OpRename {
+		// Changes to what was renamed are replayed from its new location, after the rename
+		var moved []outboxEntry
+		kept := o.Entries[:0:0]
+		for _, queued := range o.Entries {
+			if target, ok := common.RebasePath(queued.Path, entry.Path, entry.NewPath); ok && queued.Op != common.OpRename {
+				queued.Path = target
+				moved = append(moved, queued)
+				continue
+			}
+			kept = append(kept, queued)
+		}
+		o.Entries = append(append(kept, entry), moved...)
+		return
+	}
+	kept := o.Entries[:0:0]
+	superseded := true
+	for i := len(o.Entries) - 1; i >= 0; i-- {
+		queued := o.Entries[i]
+		if queued.Op == common.OpRename && (related(queued.Path, entry.Path) || related(queued.NewPath, entry.Path)) {
+			superseded = false
+		}
+		switch {
+		case !superseded || queued.Op == common.OpRename:
+		case queued.Path == entry.Path && entry.Op == common.OpMeta && queued.Op != common.OpMeta:
+			// Replaying a content change sends the metadata too
+			return
+		case queued.Path == entry.Path:
+			// The oldest base is what the server still holds
+			if queued.BaseHash != nil {
+				entry.BaseHash = queued.BaseHash
+			}
+			continue
+		case entry.Op == common.OpRemove && within(queued.Path, entry.Path):
+			continue // inside a removed directory
+		}
+		kept = append(kept, queued)
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	o.Entries = append(kept, entry)
+}
+
+// Has reports whether a queued change covers path
+func (o *outbox) Has(path string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, queued := range o.Entries {
+		if queued.covers(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Take removes and returns everything queued
+func (o *outbox) Take() []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries := o.Entries
+	if len(entries) > 0 {
+		o.Entries = nil
+		o.dirty = true
+	}
+	return entries
+}
+
+// Flush saves the queue if it changed since the last save
+func (o *outbox) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.dirty {
+		return nil
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	if err := common.WriteFileAtomic(o.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write outgoing queue: %w", err)
+	}
+	o.dirty = false
+	return nil
+}
+
+// within reports whether path is dir or below it
+func within(path, dir string) bool {
+	_, ok := common.RebasePath(path, dir, dir)
+	return ok
+}
+
+// covers reports whether the change is to path, or to a directory it is in
+func (e outboxEntry) covers(path string) bool {
+	return within(path, e.Path) || (e.Op == common.OpRename && within(path, e.NewPath))
+}
+
+// related reports whether one path is the other or below it
+func related(a, b string) bool {
+	return within(a, b) || within(b, a)
+}
+
+// queueChange records a change that could not be sent for replay after reconnecting
+func (c *Client) queueChange(entry outboxEntry) {
+	log.Warn().Str("op", string(entry.Op)).Str("path", entry.Path).Msg("Change not sent, queued until reconnected")
+	c.outbox.Add(entry)
+}
+
+// replayOutbox sends the changes queued while disconnected, reading their current state from disk.
+// The manifest the server sent on connect predates them, so initial sync leaves these paths alone.
+func (c *Client) replayOutbox() {
+	entries := c.outbox.Take()
+	c.replayed = make(map[string]bool)
+	if len(entries) == 0 {
+		return
+	}
+	if !c.journal.Exists() {
+		log.Warn().Int("count", len(entries)).Msg("Dropping changes queued before the first sync, the server's copy is adopted instead")
+		return
+	}
+	log.Info().Int("count", len(entries)).Msg("Replaying changes made while disconnected")
+	for _, entry := range entries {
+		if entry.Op == common.OpRename {
+			c.markReplayed(entry.NewPath, true)
+		}
+		// A removal or rename covers everything that was below the path
+		c.markReplayed(entry.Path, entry.Op == common.OpRename || entry.Op == common.OpRemove)
+		c.resend(entry)
+	}
+}
+
+// resend sends a change again, reading its current state from disk
+func (c *Client) resend(entry outboxEntry) {
+	if entry.BaseHash != nil {
+		c.unacked.pin(entry.Path, entry.BaseHash)
+	}
+	fullPath := filepath.Join(c.cfg.SyncDir, entry.Path)
+	switch entry.Op {
+	case common.OpRename:
+		if !c.hasCapability(common.CapRename) {
+			c.sendOperation(common.FileOperationMessage{Op: common.OpRemove, Path: entry.Path})
+			c.pushLocalState(entry.NewPath)
+			return
+		}
+		c.sendOperation(common.FileOperationMessage{Op: common.OpRename, Path: entry.Path, NewPath: entry.NewPath, IsDir: entry.IsDir})
+	case common.OpMeta:
+		if info, err := os.Lstat(fullPath); err == nil && c.hasCapability(common.CapMetadata) {
+			c.sendOperation(common.FileOperationMessage{Op: common.OpMeta, Path: entry.Path, IsDir: info.IsDir(), FileMeta: common.MetaOf(info)})
+		}
+	default:
+		state, err := c.symlinks.State(fullPath)
+		if err != nil {
+			log.Error().Err(err).Str("path", entry.Path).Msg("Failed to read queued change")
+			return
+		}
+		c.push(entry.Path, state)
+	}
+}
+
+// markReplayed records that path, and everything below it for a subtree, was sent by the replay
+func (c *Client) markReplayed(path string, subtree bool) {
+	c.replayed[path] = c.replayed[path] || subtree
+}
+
+// isReplayed reports whether path was sent by the last replay, directly or as part of a moved or
+// removed directory
+func (c *Client) isReplayed(path string) bool {
+	if _, ok := c.replayed[path]; ok {
+		return true
+	}
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if c.replayed[dir] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+func write(path string) outboxEntry {
+	return outboxEntry{Op: common.OpWrite, Path: path}
+}
+
+func remove(path string) outboxEntry {
+	return outboxEntry{Op: common.OpRemove, Path: path}
+}
+
+func rename(path, newPath string) outboxEntry {
+	return outboxEntry{Op: common.OpRename, Path: path, NewPath: newPath}
+}
+
+func meta(path string) outboxEntry {
+	return outboxEntry{Op: common.OpMeta, Path: path}
+}
+
+func based(entry outboxEntry, base string) outboxEntry {
+	entry.BaseHash = &base
+	return entry
+}
+
+func TestOutboxAdd(t *testing.T) {
+	tests := []struct {
+		name  string
+		added []outboxEntry
+		want  []outboxEntry
+	}{
+		{
+			name:  "repeated writes",
+			added: []outboxEntry{write("a"), write("b"), write("a")},
+			want:  []outboxEntry{write("b"), write("a")},
+		},
+		{
+			name:  "write then remove",
+			added: []outboxEntry{write("a"), remove("a")},
+			want:  []outboxEntry{remove("a")},
+		},
+		{
+			name:  "remove then write",
+			added: []outboxEntry{remove("a"), write("a")},
+			want:  []outboxEntry{write("a")},
+		},
+		{
+			name:  "metadata after a write is sent with it",
+			added: []outboxEntry{write("a"), meta("a")},
+			want:  []outboxEntry{write("a")},
+		},
+		{
+			name:  "write after metadata",
+			added: []outboxEntry{meta("a"), write("a")},
+			want:  []outboxEntry{write("a")},
+		},
+		{
+			name:  "remove of parent drops changes below it",
+			added: []outboxEntry{write("d/x"), write("other"), write("d/sub/y"), remove("d")},
+			want:  []outboxEntry{write("other"), remove("d")},
+		},
+		{
+			name:  "remove of a sibling with a shared prefix",
+			added: []outboxEntry{write("dir2/x"), remove("dir")},
+			want:  []outboxEntry{write("dir2/x"), remove("dir")},
+		},
+		{
+			name:  "write below a removed directory",
+			added: []outboxEntry{remove("d"), write("d/x")},
+			want:  []outboxEntry{remove("d"), write("d/x")},
+		},
+		{
+			name:  "write, rename, write",
+			added: []outboxEntry{write("a"), rename("a", "b"), write("b")},
+			want:  []outboxEntry{rename("a", "b"), write("b")},
+		},
+		{
+			name:  "new file at a renamed path",
+			added: []outboxEntry{rename("a", "b"), write("a")},
+			want:  []outboxEntry{rename("a", "b"), write("a")},
+		},
+		{
+			name:  "rename moves changes below it",
+			added: []outboxEntry{write("d/f"), write("x"), rename("d", "e")},
+			want:  []outboxEntry{write("x"), rename("d", "e"), write("e/f")},
+		},
+		{
+			name:  "renames stay in order",
+			added: []outboxEntry{rename("a", "b"), rename("b", "c")},
+			want:  []outboxEntry{rename("a", "b"), rename("b", "c")},
+		},
+		{
+			name:  "unrelated rename does not keep a superseded write",
+			added: []outboxEntry{write("x"), rename("a", "b"), write("x")},
+			want:  []outboxEntry{rename("a", "b"), write("x")},
+		},
+		{
+			name:  "remove after a rename keeps it",
+			added: []outboxEntry{rename("a", "b"), remove("b")},
+			want:  []outboxEntry{rename("a", "b"), remove("b")},
+		},
+		{
+			name:  "superseding write keeps the oldest base",
+			added: []outboxEntry{based(write("a"), "h1"), based(write("a"), "h2")},
+			want:  []outboxEntry{based(write("a"), "h1")},
+		},
+		{
+			name:  "superseding write without a base takes the queued one",
+			added: []outboxEntry{based(write("a"), "h1"), write("a")},
+			want:  []outboxEntry{based(write("a"), "h1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &outbox{}
+			for _, entry := range tt.added {
+				o.Add(entry)
+			}
+			if !reflect.DeepEqual(o.Entries, tt.want) {
+				t.Errorf("entries = %+v, want %+v", o.Entries, tt.want)
+			}
+		})
+	}
+}
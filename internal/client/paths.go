@@ -0,0 +1,35 @@
+package client
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// checkPath validates a path received from the server and tells the server when it is refused
+func (c *Client) checkPath(path string) bool {
+	if _, err := common.SafeJoin(c.cfg.SyncDir, path); err != nil {
+		log.Error().Err(err).Msg("Refusing path from server")
+		c.sendMessage(common.TypeInvalidPath, common.InvalidPathMessage{Path: path, Reason: err.Error()})
+		return false
+	}
+	return true
+}
+
+// checkLinkTarget validates the target of a symlink received from the server like checkPath
+func (c *Client) checkLinkTarget(path, target string) bool {
+	if err := common.ValidateLinkTarget(path, target); err != nil {
+		log.Error().Err(err).Msg("Refusing symlink from server")
+		c.sendMessage(common.TypeInvalidPath, common.InvalidPathMessage{Path: path, Reason: err.Error()})
+		return false
+	}
+	return true
+}
+
+func (c *Client) handleInvalidPath(wrapper common.MessageWrapper) {
+	var msg common.InvalidPathMessage
+	if err := common.DecodePayload(wrapper, &msg); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal invalid path message")
+		return
+	}
+	log.Error().Str("path", msg.Path).Str("reason", msg.Reason).Msg("Server refused a path, the change was not synced")
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// renameWindow is how long a path renamed away waits for the create event of its new name
+// before it is treated as removed
+const renameWindow = 200 * time.Millisecond
+
+type inode struct {
+	id    uint64 // 0 where the platform has no inode numbers
+	isDir bool
+}
+
+type pendingRename struct {
+	path  string
+	inode inode
+	hash  string // last-synced hash, used to pair files without an inode
+	timer *time.Timer
+}
+
+// watchable decides which directories the watcher follows and remembers the inode of every entry
+func (c *Client) watchable(path string, info os.FileInfo) bool {
+	relPath, err := filepath.Rel(c.cfg.SyncDir, path)
+	if err != nil {
+		return false
+	}
+	if relPath == "." {
+		return true
+	}
+	if c.ignorer.IsIgnored(relPath) {
+		return false
+	}
+	c.rememberInode(relPath, info)
+	c.expected.SetMode(relPath, common.MetaOf(info).Mode)
+	return true
+}
+
+// isDirEvent reports whether event is about a directory, going by the remembered inodes for paths
+// that no longer exist
+func (c *Client) isDirEvent(event fsnotify.Event) bool {
+	if info, err := os.Lstat(event.Name); err == nil {
+		return info.IsDir()
+	}
+	relPath, err := filepath.Rel(c.cfg.SyncDir, event.Name)
+	if err != nil {
+		return false
+	}
+	c.renameMutex.Lock()
+	defer c.renameMutex.Unlock()
+	return c.inodes[relPath].isDir
+}
+
+func (c *Client) rememberInode(relPath string, info os.FileInfo) {
+	id, _ := common.FileID(info)
+	c.renameMutex.Lock()
+	defer c.renameMutex.Unlock()
+	c.inodes[relPath] = inode{id: id, isDir: info.IsDir()}
+}
+
+// trackSynced watches and remembers the inodes of path and any parent directories the sync engine
+// just created, as their watcher events are not relied upon
+func (c *Client) trackSynced(path string) {
+	dir := filepath.Dir(path)
+	for dir != "." {
+		c.renameMutex.Lock()
+		_, known := c.inodes[dir]
+		c.renameMutex.Unlock()
+		if known {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	// Everything below the deepest known ancestor is new
+	top := path
+	for parent := filepath.Dir(top); parent != dir; parent = filepath.Dir(parent) {
+		top = parent
+	}
+	common.WatchTree(c.watcher, c.symlinks, filepath.Join(c.cfg.SyncDir, top), c.watchable)
+}
+
+// moveInodes re-keys the remembered inodes of path and everything below it; an empty newPath forgets them
+func (c *Client) moveInodes(path, newPath string) {
+	c.renameMutex.Lock()
+	defer c.renameMutex.Unlock()
+	moved := make(map[string]inode)
+	for p, entry := range c.inodes {
+		if target, ok := common.RebasePath(p, path, newPath); ok {
+			delete(c.inodes, p)
+			if newPath != "" {
+				moved[target] = entry
+			}
+		}
+	}
+	for p, entry := range moved {
+		c.inodes[p] = entry
+	}
+}
+
+// deferRemoval holds back the removal of a path that was renamed away, as it may reappear under a
+// new name within the sync directory
+func (c *Client) deferRemoval(relPath string) {
+	c.renameMutex.Lock()
+	defer c.renameMutex.Unlock()
+	if _, exists := c.pendingRenames[relPath]; exists {
+		return
+	}
+	pending := &pendingRename{path: relPath, inode: c.inodes[relPath]}
+	pending.hash, _ = c.journal.Get(relPath)
+	pending.timer = time.AfterFunc(renameWindow, func() { c.expireRename(pending) })
+	c.pendingRenames[relPath] = pending
+}
+
+func (c *Client) expireRename(pending *pendingRename) {
+	c.renameMutex.Lock()
+	if c.pendingRenames[pending.path] != pending {
+		c.renameMutex.Unlock()
+		return
+	}
+	delete(c.pendingRenames, pending.path)
+	c.renameMutex.Unlock()
+	if _, err := os.Lstat(filepath.Join(c.cfg.SyncDir, pending.path)); err == nil {
+		return // Replaced by a new file, which its own create event sends
+	}
+	c.sendRemoval(pending.path)
+}
+
+// matchRename returns the source of a pending rename that relPath is the new name of
+func (c *Client) matchRename(relPath string, info os.FileInfo) (string, bool) {
+	c.renameMutex.Lock()
+	defer c.renameMutex.Unlock()
+	if len(c.pendingRenames) == 0 {
+		return "", false
+	}
+	id, hasID := common.FileID(info)
+	var hash string
+	for path, pending := range c.pendingRenames {
+		if pending.inode.isDir != info.IsDir() && pending.inode != (inode{}) {
+			continue
+		}
+		matched := hasID && pending.inode.id != 0 && pending.inode.id == id
+		if !matched && !info.IsDir() && pending.hash != "" {
+			if hash == "" {
+				hash, _ = c.index.State(filepath.Join(c.cfg.SyncDir, relPath), info)
+			}
+			matched = hash == pending.hash
+		}
+		if matched {
+			pending.timer.Stop()
+			delete(c.pendingRenames, path)
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// sendRename propagates a local rename of path to newPath
+func (c *Client) sendRename(path, newPath string, isDir bool) {
+	c.expected.Set(path, common.StateRemoved)
+	if isDir {
+		common.UnwatchTree(c.watcher, filepath.Join(c.cfg.SyncDir, path))
+		common.WatchTree(c.watcher, c.symlinks, filepath.Join(c.cfg.SyncDir, newPath), c.watchable)
+	}
+	c.moveInodes(path, newPath)
+	c.index.MoveTree(path, newPath)
+	if !c.hasCapability(common.CapRename) {
+		c.sendRemoval(path)
+		c.pushLocalState(newPath)
+		return
+	}
+	log.Info().Str("path", path).Str("new_path", newPath).Msg("Detected local rename, sending to server")
+	c.sendOperation(common.FileOperationMessage{Op: common.OpRename, Path: path, NewPath: newPath, IsDir: isDir})
+}
+
+// sendRemoval propagates the local removal of path
+func (c *Client) sendRemoval(path string) {
+	c.expected.Set(path, common.StateRemoved)
+	common.UnwatchTree(c.watcher, filepath.Join(c.cfg.SyncDir, path))
+	c.moveInodes(path, "")
+	log.Info().Str("op", string(common.OpRemove)).Str("path", path).Msg("Detected local change, sending to server")
+	c.sendOperation(common.FileOperationMessage{Op: common.OpRemove, Path: path})
+}
+
+// applyRename moves a local file or directory for a rename from the server, fetching the result
+// instead when there is nothing to move
+func (c *Client) applyRename(op *common.FileOperationMessage) {
+	if !c.checkPath(op.NewPath) {
+		return
+	}
+	oldPath := filepath.Join(c.cfg.SyncDir, op.Path)
+	newPath := filepath.Join(c.cfg.SyncDir, op.NewPath)
+	if _, err := os.Lstat(oldPath); err != nil {
+		c.requestFiles([]string{op.NewPath})
+		return
+	}
+	state := common.StateDir
+	if !op.IsDir {
+		if state, _ = c.journal.Get(op.Path); state == "" {
+			state, _ = c.symlinks.State(oldPath)
+		}
+	}
+	c.expected.ExpectParents(c.cfg.SyncDir, op.NewPath)
+	c.expected.Set(op.Path, common.StateRemoved)
+	c.expected.Set(op.NewPath, state)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		log.Error().Err(err).Str("path", op.NewPath).Msg("Failed to create parent directories")
+		return
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		log.Error().Err(err).Str("path", op.Path).Str("new_path", op.NewPath).Msg("Failed to rename, fetching from server instead")
+		c.requestFiles([]string{op.NewPath})
+		return
+	}
+	c.journal.MoveTree(op.Path, op.NewPath)
+	c.index.MoveTree(op.Path, op.NewPath)
+	if op.IsDir {
+		common.UnwatchTree(c.watcher, oldPath)
+	}
+	c.moveInodes(op.Path, op.NewPath)
+	c.trackSynced(op.NewPath)
+}
+
+func (c *Client) handleRenameRejected(wrapper common.MessageWrapper) {
+	var msg common.RenameRejectedMessage
+	if err := common.DecodePayload(wrapper, &msg); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal rename rejection")
+		return
+	}
+	log.Warn().Str("path", msg.Path).Str("new_path", msg.NewPath).Str("reason", msg.Reason).Msg("Server rejected rename, sending renamed path in full")
+	// The server has nothing at the new path that this client synced
+	c.journal.DeleteTree(msg.NewPath)
+	c.pushLocalState(msg.NewPath)
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// resumePoint is where the client got to in the server's operation log, or nil if it must be
+// sent a manifest because the last connection never finished its initial sync
+func (c *Client) resumePoint() *common.ResumePoint {
+	if !c.resumable || c.epoch == "" {
+		return nil
+	}
+	point := &common.ResumePoint{Epoch: c.epoch, Seq: c.seq}
+	for path := range c.requested {
+		point.Pending = append(point.Pending, path)
+	}
+	return point
+}
+
+// advance records that everything up to seq in the server's operation log has been received
+func (c *Client) advance(seq uint64) {
+	c.seq = max(c.seq, seq)
+}
+
+// handleResume catches up on the paths the server changed while disconnected. Everything outside
+// them is as it was, so the local entries stand in for the server's like settled subtrees do in
+// a tree sync.
+func (c *Client) handleResume(wrapper common.MessageWrapper) {
+	var msg common.ResumeMessage
+	if err := common.DecodePayload(wrapper, &msg); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal resume")
+		return
+	}
+	c.advance(msg.Seq)
+	local, err := common.BuildFileManifest(c.cfg.SyncDir, c.ignorer, c.symlinks, c.index)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to build local manifest for sync")
+		return
+	}
+	server := msg.Manifest
+	if server.Files == nil {
+		server.Files = make(map[string]string)
+	}
+	for path, state := range local.States() {
+		if inScope(msg.Scopes, path) {
+			continue
+		}
+		if state == common.StateDir {
+			server.Dirs = append(server.Dirs, path)
+			continue
+		}
+		server.Files[path] = state
+		if meta, ok := local.Meta[path]; ok && server.Meta != nil {
+			server.Meta[path] = meta
+		}
+	}
+	log.Info().Int("paths", len(msg.Scopes)).Uint64("seq", msg.Seq).Msg("Resumed from server operation log. Syncing changed paths.")
+	c.syncManifest(server, local)
+}
+
+// inScope reports whether path is one of the scopes or below one covering its whole subtree
+func inScope(scopes map[string]bool, path string) bool {
+	for p := path; ; p = filepath.Dir(p) {
+		if subtree, ok := scopes[p]; ok && (subtree || p == path) {
+			return true
+		}
+		if p == common.TreeRoot {
+			return false
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// fakeServer speaks just enough of the protocol to hand each connection to a test script
+type fakeServer struct {
+	t        *testing.T
+	sessions chan *fakeSession
+}
+
+type fakeSession struct {
+	t      *testing.T
+	conn   *websocket.Conn
+	codec  common.Codec
+	resume *common.ResumePoint
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, string) {
+	f := &fakeServer{t: t, sessions: make(chan *fakeSession, 4)}
+	upgrader := websocket.Upgrader{Subprotocols: []string{common.SubprotocolJSON}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		session := &fakeSession{t: t, conn: conn, codec: common.CodecFor(conn.Subprotocol())}
+		var hello common.HelloMessage
+		session.expect(common.TypeHello, &hello)
+		session.resume = hello.Resume
+		session.send(common.TypeWelcome, common.WelcomeMessage{
+			ProtocolVersion: common.ProtocolVersion,
+			Capabilities:    []common.Capability{common.CapDelta, common.CapOpLog, common.CapAcks},
+			Epoch:           "epoch",
+		})
+		f.sessions <- session
+	}))
+	t.Cleanup(server.Close)
+	return f, "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+}
+
+func (f *fakeServer) next() *fakeSession {
+	select {
+	case session := <-f.sessions:
+		return session
+	case <-time.After(10 * time.Second):
+		f.t.Fatal("client did not connect")
+		return nil
+	}
+}
+
+func (s *fakeSession) send(msgType common.MessageType, payload any) {
+	frameType, data, err := s.codec.Encode(msgType, payload)
+	if err == nil {
+		err = s.conn.WriteMessage(frameType, data)
+	}
+	if err != nil {
+		s.t.Errorf("failed to send %s: %v", msgType, err)
+	}
+}
+
+// read returns the next message from the client, or false once the connection is closed
+func (s *fakeSession) read() (common.MessageWrapper, bool) {
+	s.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	frameType, data, err := s.conn.ReadMessage()
+	if err != nil {
+		return common.MessageWrapper{}, false
+	}
+	wrapper, err := s.codec.Decode(frameType, data)
+	if err != nil {
+		s.t.Errorf("failed to decode message: %v", err)
+		return common.MessageWrapper{}, false
+	}
+	return wrapper, true
+}
+
+func (s *fakeSession) expect(msgType common.MessageType, payload any) {
+	wrapper, ok := s.read()
+	if !ok || wrapper.Type != msgType {
+		s.t.Fatalf("expected %s, got %q", msgType, wrapper.Type)
+	}
+	if err := common.DecodePayload(wrapper, payload); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// upload waits for the client to start sending path, either whole or by asking for a signature
+func (s *fakeSession) upload(path string) bool {
+	for {
+		wrapper, ok := s.read()
+		if !ok {
+			return false
+		}
+		switch wrapper.Type {
+		case common.TypeSignatureRequest:
+			var req common.SignatureRequestMessage
+			if common.DecodePayload(wrapper, &req) == nil && req.Path == path {
+				return true
+			}
+		case common.TypeFileOperation:
+			var op common.FileOperationMessage
+			if common.DecodePayload(wrapper, &op) == nil && op.Path == path && op.Op == common.OpWrite {
+				return true
+			}
+		}
+	}
+}
+
+// TestResumeAfterSignatureRequest cuts the connection between a delta upload's signature request
+// and its reply, and checks the change is still sent once the client resumes
+func TestResumeAfterSignatureRequest(t *testing.T) {
+	server, addr := newFakeServer(t)
+	dir := t.TempDir()
+	old := make([]byte, 2*common.MinDeltaSize)
+	rand.New(rand.NewSource(1)).Read(old)
+	edited := bytes.Clone(old)
+	copy(edited[1000:], "edited while connected")
+	if err := os.WriteFile(filepath.Join(dir, "big.bin"), edited, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(Config{ServerAddr: addr, SyncDir: dir, Symlinks: string(common.SymlinksPreserve), RetryMin: 10 * time.Millisecond, RetryMax: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.journal.Set("big.bin", common.HashBytes(old))
+	if err := c.journal.Save(); err != nil {
+		t.Fatal(err)
+	}
+	go c.Run()
+
+	first := server.next()
+	first.send(common.TypeManifest, common.ManifestMessage{Files: map[string]string{"big.bin": common.HashBytes(old)}})
+	if !first.upload("big.bin") {
+		t.Fatal("edit was never sent")
+	}
+	first.conn.Close()
+
+	second := server.next()
+	if second.resume == nil {
+		t.Fatal("client did not ask to resume")
+	}
+	// Nothing changed on the server, so the catch-up is empty
+	second.send(common.TypeResume, common.ResumeMessage{Seq: second.resume.Seq, Scopes: map[string]bool{}})
+	if !second.upload("big.bin") {
+		t.Error("edit cut off by the disconnect was not sent after resuming")
+	}
+	if state, _ := c.journal.Get("big.bin"); state != common.HashBytes(old) {
+		t.Error("journal records the unsent edit as synced")
+	}
+	second.conn.Close()
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// sendLink propagates a local symlink; servers that don't preserve links never see it
+func (c *Client) sendLink(path string) {
+	target, err := os.Readlink(filepath.Join(c.cfg.SyncDir, path))
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Failed to read symlink for sending")
+		return
+	}
+	if !c.hasCapability(common.CapSymlinks) {
+		log.Debug().Str("path", path).Msg("Server does not preserve symlinks, link not sent")
+		return
+	}
+	c.sendOperation(common.FileOperationMessage{Op: common.OpWrite, Path: path, LinkTarget: target})
+}
+
+// writeLocalLink creates a symlink from the server and records it in the journal
+func (c *Client) writeLocalLink(op *common.FileOperationMessage) {
+	if !c.checkLinkTarget(op.Path, op.LinkTarget) {
+		return
+	}
+	c.expected.ExpectParents(c.cfg.SyncDir, op.Path)
+	c.expected.Set(op.Path, op.ContentHash())
+	if err := common.CreateSymlink(filepath.Join(c.cfg.SyncDir, op.Path), op.LinkTarget); err != nil {
+		log.Error().Err(err).Str("path", op.Path).Msg("Failed to create symlink")
+		return
+	}
+	c.journal.Set(op.Path, op.ContentHash())
+	c.trackSynced(op.Path)
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// streamFile uploads a large local file as a chunked transfer carrying a write operation
+func (c *Client) streamFile(path string, info os.FileInfo) {
+	op := common.FileOperationMessage{Op: common.OpWrite, Path: path, FileMeta: common.MetaOf(info)}
+	c.setBaseHash(&op)
+	c.track(&op)
+	begin := common.TransferBeginMessage{Path: path, Op: &op}
+	hash, err := common.StreamFile(filepath.Join(c.cfg.SyncDir, path), begin, c.sendMessage)
+	if err != nil {
+		log.Warn().Err(err).Str("path", path).Msg("Failed to stream file")
+		c.untrack(op.ID)
+		c.queueChange(outboxEntry{Op: common.OpWrite, Path: path, BaseHash: op.BaseHash})
+		return
+	}
+	if op.ID != "" {
+		c.unacked.setState(op.ID, hash)
+		return
+	}
+	c.journal.Set(path, hash)
+}
+
+func (c *Client) handleTransferBegin(wrapper common.MessageWrapper) {
+	var begin common.TransferBeginMessage
+	if err := common.DecodePayload(wrapper, &begin); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal transfer begin")
+		return
+	}
+	if !c.checkPath(begin.Path) {
+		return
+	}
+	transfer, err := common.NewIncomingTransfer(c.cfg.SyncDir, begin)
+	if err != nil {
+		log.Error().Err(err).Str("path", begin.Path).Msg("Failed to start transfer")
+		return
+	}
+	log.Info().Str("path", begin.Path).Int64("size", begin.Size).Msg("Receiving file transfer from server")
+	c.transfers[begin.ID] = transfer
+}
+
+func (c *Client) handleTransferChunk(wrapper common.MessageWrapper) {
+	var chunk common.TransferChunkMessage
+	if err := common.DecodePayload(wrapper, &chunk); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal transfer chunk")
+		return
+	}
+	transfer, ok := c.transfers[chunk.ID]
+	if !ok {
+		return
+	}
+	if err := transfer.Write(chunk); err != nil {
+		log.Error().Err(err).Str("path", transfer.Begin.Path).Msg("Failed to write transfer chunk")
+		transfer.Abort()
+		delete(c.transfers, chunk.ID)
+	}
+}
+
+func (c *Client) handleTransferCommit(wrapper common.MessageWrapper) {
+	var commit common.TransferCommitMessage
+	if err := common.DecodePayload(wrapper, &commit); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal transfer commit")
+		return
+	}
+	transfer, ok := c.transfers[commit.ID]
+	if !ok {
+		return
+	}
+	delete(c.transfers, commit.ID)
+	tmpPath, err := transfer.Commit(commit.Hash)
+	if err != nil {
+		log.Error().Err(err).Str("path", transfer.Begin.Path).Msg("Failed to commit transfer, requesting file again")
+		c.requestFiles([]string{transfer.Begin.Path})
+		return
+	}
+	op := common.FileOperationMessage{Op: common.OpWrite}
+	if transfer.Begin.Op != nil {
+		op = *transfer.Begin.Op
+		c.advance(op.Seq)
+	}
+	op.Path = transfer.Begin.Path
+	op.Content = nil
+	op.ContentPath = tmpPath
+	op.Hash = commit.Hash
+	log.Info().Str("path", op.Path).Msg("Received file transfer from server")
+	c.writeLocalFile(&op)
+}
+
+func (c *Client) handleTransferAbort(wrapper common.MessageWrapper) {
+	var abort common.TransferAbortMessage
+	if err := common.DecodePayload(wrapper, &abort); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal transfer abort")
+		return
+	}
+	if transfer, ok := c.transfers[abort.ID]; ok {
+		log.Warn().Str("path", transfer.Begin.Path).Str("reason", abort.Reason).Msg("Server aborted transfer")
+		transfer.Abort()
+		delete(c.transfers, abort.ID)
+	}
+}
+
+func (c *Client) abortTransfers() {
+	for id, transfer := range c.transfers {
+		transfer.Abort()
+		delete(c.transfers, id)
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// treeSync is an initial sync by manifest tree in progress
+type treeSync struct {
+	local common.ManifestMessage
+	tree  *common.ManifestTree
+	// server holds the server's entries below directories whose hashes differ
+	server common.ManifestMessage
+	// settled are the paths whose hashes match the server, along with everything below them
+	settled map[string]bool
+	// pending are the directories requested and not yet listed
+	pending map[string]bool
+}
+
+// handleManifestTree compares the server's manifest tree with the local one, requesting the
+// listings of differing directories level by level; a message without listings announces the root
+func (c *Client) handleManifestTree(wrapper common.MessageWrapper) {
+	var msg common.ManifestTreeMessage
+	if err := common.DecodePayload(wrapper, &msg); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal manifest tree")
+		return
+	}
+	if msg.Listings == nil {
+		c.advance(msg.Seq)
+		c.startTreeSync(msg.Root)
+		return
+	}
+	ts := c.treeSync
+	if ts == nil {
+		log.Warn().Msg("Received manifest tree listings without a sync in progress")
+		return
+	}
+	var next []string
+	for dir, listing := range msg.Listings {
+		if !ts.pending[dir] {
+			continue
+		}
+		delete(ts.pending, dir)
+		for _, entry := range listing {
+			if filepath.Dir(entry.Path) != dir || !c.checkPath(entry.Path) {
+				continue
+			}
+			if local, ok := ts.tree.Entry(entry.Path); ok && local.Hash == entry.Hash {
+				ts.settled[entry.Path] = true
+				continue
+			}
+			if entry.State == common.StateDir {
+				ts.server.Dirs = append(ts.server.Dirs, entry.Path)
+				next = append(next, entry.Path)
+				continue
+			}
+			ts.server.Files[entry.Path] = entry.State
+			if entry.FileMeta != (common.FileMeta{}) {
+				ts.server.Meta[entry.Path] = entry.FileMeta
+			}
+		}
+	}
+	if len(ts.pending) > 0 {
+		return
+	}
+	if len(next) > 0 {
+		c.requestListings(next)
+		return
+	}
+	c.finishTreeSync()
+}
+
+func (c *Client) startTreeSync(root string) {
+	local, err := common.BuildFileManifest(c.cfg.SyncDir, c.ignorer, c.symlinks, c.index)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to build local manifest for sync")
+		return
+	}
+	c.treeSync = &treeSync{
+		local:   local,
+		tree:    common.NewManifestTree(&local),
+		server:  common.ManifestMessage{Files: make(map[string]string), Meta: make(map[string]common.FileMeta)},
+		settled: make(map[string]bool),
+		pending: make(map[string]bool),
+	}
+	if root == c.treeSync.tree.Root() {
+		log.Info().Msg("Server manifest tree matches local tree")
+		c.treeSync.settled[common.TreeRoot] = true
+		c.finishTreeSync()
+		return
+	}
+	log.Info().Msg("Received server manifest tree. Comparing directories that differ.")
+	c.requestListings([]string{common.TreeRoot})
+}
+
+func (c *Client) requestListings(dirs []string) {
+	for _, dir := range dirs {
+		c.treeSync.pending[dir] = true
+	}
+	if err := c.sendMessage(common.TypeTreeRequest, common.TreeRequestMessage{Dirs: dirs}); err != nil {
+		log.Error().Err(err).Msg("Failed to request manifest tree listings")
+		c.treeSync = nil
+	}
+}
+
+// finishTreeSync completes the server manifest with the local entries of matching subtrees and
+// syncs against it
+func (c *Client) finishTreeSync() {
+	ts := c.treeSync
+	c.treeSync = nil
+	for path, state := range ts.local.States() {
+		if !ts.isSettled(path) {
+			continue
+		}
+		if state == common.StateDir {
+			ts.server.Dirs = append(ts.server.Dirs, path)
+			continue
+		}
+		ts.server.Files[path] = state
+		if meta, ok := ts.local.Meta[path]; ok {
+			ts.server.Meta[path] = meta
+		}
+	}
+	c.syncManifest(ts.server, ts.local)
+}
+
+// isSettled reports whether path or one of its parents matched the server
+func (ts *treeSync) isSettled(path string) bool {
+	for {
+		if ts.settled[path] {
+			return true
+		}
+		if path == common.TreeRoot {
+			return false
+		}
+		path = filepath.Dir(path)
+	}
+}
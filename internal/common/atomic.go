@@ -0,0 +1,62 @@
+package common
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// atomicTempPrefix marks the hidden temp files of in-progress atomic writes, which are never synced
+const atomicTempPrefix = StateDirName + "-write-"
+
+// IsAtomicTemp reports whether path is the temp file of an atomic write
+func IsAtomicTemp(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), atomicTempPrefix)
+}
+
+// WriteFileAtomic writes data to a hidden temp file next to fullPath, flushes it to disk and renames
+// it into place, so readers see either the old or the new content and never a partial file. The
+// directory is flushed too, so the rename is on disk once it returns.
+func WriteFileAtomic(fullPath string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create parent directories: %w", err)
+	}
+	file, err := os.CreateTemp(dir, atomicTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), fullPath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return SyncDir(dir)
+}
+
+// removeAtomicTemps deletes temp files left behind by atomic writes interrupted by a crash
+func removeAtomicTemps(syncDir string) error {
+	return filepath.WalkDir(syncDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !entry.IsDir() && IsAtomicTemp(path) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
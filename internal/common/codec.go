@@ -0,0 +1,158 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Websocket subprotocols offered at connect time, most preferred first. Peers that offer
+// none (older clients) are spoken to in plain JSON.
+const (
+	SubprotocolBinary = "fs-entangle.binary.v1"
+	SubprotocolJSON   = "fs-entangle.json.v1"
+)
+
+var Subprotocols = []string{SubprotocolBinary, SubprotocolJSON}
+
+// Codec turns messages into websocket frames and back
+type Codec interface {
+	Name() string
+	Encode(msgType MessageType, payload any) (int, []byte, error)
+	Decode(frameType int, data []byte) (MessageWrapper, error)
+}
+
+// CodecFor returns the codec for a negotiated subprotocol
+func CodecFor(subprotocol string) Codec {
+	if subprotocol == SubprotocolBinary {
+		return binaryCodec{}
+	}
+	return jsonCodec{}
+}
+
+// rawEncoder is implemented by payloads whose bulk bytes can travel outside the JSON header
+type rawEncoder interface {
+	rawBytes() []byte
+	withoutRaw() any
+}
+
+type rawDecoder interface {
+	setRaw([]byte)
+}
+
+// DecodePayload unmarshals a received message's payload into v, reattaching any raw bytes
+func DecodePayload(msg MessageWrapper, v any) error {
+	if err := json.Unmarshal(msg.Payload, v); err != nil {
+		return err
+	}
+	if decoder, ok := v.(rawDecoder); ok && len(msg.Data) > 0 {
+		decoder.setRaw(msg.Data)
+	}
+	return nil
+}
+
+// jsonCodec is the original wire format: a JSON text frame with base64 file content
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return SubprotocolJSON }
+
+func (jsonCodec) Encode(msgType MessageType, payload any) (int, []byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := json.Marshal(MessageWrapper{Type: msgType, Payload: body})
+	return websocket.TextMessage, data, err
+}
+
+func (jsonCodec) Decode(frameType int, data []byte) (MessageWrapper, error) {
+	var msg MessageWrapper
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// binaryFrameVersion is bumped whenever the binary frame layout changes
+const binaryFrameVersion = 1
+
+// binaryCodec frames a message as
+//
+//	version (1 byte) | type length (1 byte) | type | header length (4 bytes, big endian) | JSON header | raw bytes
+//
+// so file content travels as raw bytes instead of base64
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return SubprotocolBinary }
+
+func (binaryCodec) Encode(msgType MessageType, payload any) (int, []byte, error) {
+	var raw []byte
+	if encoder, ok := payload.(rawEncoder); ok {
+		raw = encoder.rawBytes()
+		payload = encoder.withoutRaw()
+	}
+	header, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(msgType) > 255 {
+		return 0, nil, fmt.Errorf("message type %q too long", msgType)
+	}
+	data := make([]byte, 0, 2+len(msgType)+4+len(header)+len(raw))
+	data = append(data, binaryFrameVersion, byte(len(msgType)))
+	data = append(data, msgType...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(header)))
+	data = append(data, header...)
+	data = append(data, raw...)
+	return websocket.BinaryMessage, data, nil
+}
+
+var errShortFrame = errors.New("binary frame too short")
+
+func (binaryCodec) Decode(frameType int, data []byte) (MessageWrapper, error) {
+	var msg MessageWrapper
+	if frameType == websocket.TextMessage {
+		// Tolerate JSON frames so either side can fall back without renegotiating
+		return jsonCodec{}.Decode(frameType, data)
+	}
+	if len(data) < 2 {
+		return msg, errShortFrame
+	}
+	if data[0] != binaryFrameVersion {
+		return msg, fmt.Errorf("unsupported binary frame version %d", data[0])
+	}
+	typeEnd := 2 + int(data[1])
+	if len(data) < typeEnd+4 {
+		return msg, errShortFrame
+	}
+	msg.Type = MessageType(data[2:typeEnd])
+	headerEnd := typeEnd + 4 + int(binary.BigEndian.Uint32(data[typeEnd:typeEnd+4]))
+	if headerEnd < typeEnd+4 || len(data) < headerEnd {
+		return msg, errShortFrame
+	}
+	msg.Payload = data[typeEnd+4 : headerEnd]
+	msg.Data = data[headerEnd:]
+	return msg, nil
+}
+
+func (m FileContentMessage) rawBytes() []byte { return m.Content }
+func (m FileContentMessage) withoutRaw() any {
+	m.Content = nil
+	return m
+}
+func (m *FileContentMessage) setRaw(data []byte) { m.Content = data }
+
+func (m FileOperationMessage) rawBytes() []byte { return m.Content }
+func (m FileOperationMessage) withoutRaw() any {
+	m.Content = nil
+	return m
+}
+func (m *FileOperationMessage) setRaw(data []byte) { m.Content = data }
+
+func (m TransferChunkMessage) rawBytes() []byte { return m.Data }
+func (m TransferChunkMessage) withoutRaw() any {
+	m.Data = nil
+	return m
+}
+func (m *TransferChunkMessage) setRaw(data []byte) { m.Data = data }
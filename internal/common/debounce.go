@@ -0,0 +1,84 @@
+package common
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// SettleDelay is how long a path has to go without events before it is synced
+	SettleDelay = 300 * time.Millisecond
+	// MaxSettleDelay bounds the wait for paths that never stop changing, like growing logs
+	MaxSettleDelay = 5 * time.Second
+)
+
+// pathEvents accumulates the watcher events of one path until it settles
+type pathEvents struct {
+	seq     uint64
+	op      fsnotify.Op
+	gone    fsnotify.Op // the last of Remove or Rename seen
+	existed bool        // whether the path existed before its first event
+	first   time.Time
+	last    time.Time
+}
+
+// Debouncer coalesces bursts of watcher events per path, so an editor saving in several writes
+// or a file created and deleted again within the burst costs one operation or none
+type Debouncer struct {
+	paths map[string]*pathEvents
+	seq   uint64
+}
+
+func NewDebouncer() *Debouncer {
+	return &Debouncer{paths: make(map[string]*pathEvents)}
+}
+
+// Add records event as seen at now
+func (d *Debouncer) Add(event fsnotify.Event, now time.Time) {
+	p, ok := d.paths[event.Name]
+	if !ok {
+		d.seq++
+		p = &pathEvents{seq: d.seq, existed: event.Op&fsnotify.Create == 0, first: now}
+		d.paths[event.Name] = p
+	}
+	p.op |= event.Op
+	if event.Op&fsnotify.Rename != 0 {
+		p.gone = fsnotify.Rename
+	} else if event.Op&fsnotify.Remove != 0 {
+		p.gone = fsnotify.Remove
+	}
+	p.last = now
+}
+
+// Settled removes the paths that settled by now and returns one merged event for each, in the
+// order the paths first changed so a rename's source comes before its destination
+func (d *Debouncer) Settled(now time.Time) []fsnotify.Event {
+	var ready []string
+	for name, p := range d.paths {
+		if now.Sub(p.last) >= SettleDelay || now.Sub(p.first) >= MaxSettleDelay {
+			ready = append(ready, name)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return d.paths[ready[i]].seq < d.paths[ready[j]].seq })
+	var events []fsnotify.Event
+	for _, name := range ready {
+		p := d.paths[name]
+		delete(d.paths, name)
+		if _, err := os.Lstat(name); err != nil {
+			if p.existed {
+				events = append(events, fsnotify.Event{Name: name, Op: p.gone})
+			}
+			// Otherwise it was created and removed again within the burst
+			continue
+		}
+		op := p.op &^ (fsnotify.Remove | fsnotify.Rename)
+		if p.gone != 0 {
+			op |= fsnotify.Create // replaced by a new file
+		}
+		events = append(events, fsnotify.Event{Name: name, Op: op})
+	}
+	return events
+}
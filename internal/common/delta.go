@@ -0,0 +1,269 @@
+package common
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	// Files smaller than this are always sent whole
+	MinDeltaSize = 64 * 1024
+
+	minBlockSize = 2 * 1024
+	maxBlockSize = 128 * 1024
+)
+
+var ErrDeltaTooLarge = errors.New("delta exceeds literal limit")
+
+// MaxDeltaLiteral is the most literal data worth sending as a delta instead of the whole content;
+// it is capped because literal data is held in memory
+func MaxDeltaLiteral(size int64) int64 {
+	return min(size*3/4, 8*StreamThreshold)
+}
+
+type BlockSignature struct {
+	Weak   uint32 `json:"w"`
+	Strong string `json:"s"`
+}
+
+// Signature describes a base file as a list of block checksums, rsync style
+type Signature struct {
+	Hash      string           `json:"hash"`
+	Size      int64            `json:"size"`
+	BlockSize int              `json:"block_size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// DeltaOp either copies Count blocks starting at Block from the base or inserts Data
+type DeltaOp struct {
+	Block int    `json:"b,omitempty"`
+	Count int    `json:"n,omitempty"`
+	Data  []byte `json:"d,omitempty"`
+}
+
+func blockSizeFor(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	return min(max(blockSize, minBlockSize), maxBlockSize)
+}
+
+func strongSum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+// weakSum is the rsync rolling checksum of a block
+func weakSum(block []byte) (uint32, uint32) {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func ComputeSignature(r io.Reader, size int64) (*Signature, error) {
+	sig := &Signature{Size: size, BlockSize: blockSizeFor(size)}
+	hash := sha256.New()
+	block := make([]byte, sig.BlockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			hash.Write(block[:n])
+			a, b := weakSum(block[:n])
+			sig.Blocks = append(sig.Blocks, BlockSignature{Weak: a | b<<16, Strong: strongSum(block[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	sig.Hash = hex.EncodeToString(hash.Sum(nil))
+	return sig, nil
+}
+
+// FileSignature computes the signature of the file at path
+func FileSignature(path string) (*Signature, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ComputeSignature(file, info.Size())
+}
+
+type deltaBuilder struct {
+	ops        []DeltaOp
+	literal    []byte
+	literals   int64
+	maxLiteral int64
+}
+
+func (d *deltaBuilder) addLiteral(c byte) error {
+	d.literal = append(d.literal, c)
+	d.literals++
+	if d.maxLiteral > 0 && d.literals > d.maxLiteral {
+		return ErrDeltaTooLarge
+	}
+	return nil
+}
+
+func (d *deltaBuilder) flushLiteral() {
+	if len(d.literal) > 0 {
+		d.ops = append(d.ops, DeltaOp{Data: d.literal})
+		d.literal = nil
+	}
+}
+
+func (d *deltaBuilder) addCopy(block int) {
+	d.flushLiteral()
+	if last := len(d.ops) - 1; last >= 0 && d.ops[last].Data == nil && d.ops[last].Block+d.ops[last].Count == block {
+		d.ops[last].Count++
+		return
+	}
+	d.ops = append(d.ops, DeltaOp{Block: block, Count: 1})
+}
+
+// ComputeDelta encodes the content read from r as copies of blocks in sig plus literal data.
+// It gives up with ErrDeltaTooLarge once more than maxLiteral bytes would be sent (0 means no limit).
+func ComputeDelta(sig *Signature, r io.Reader, maxLiteral int64) ([]DeltaOp, error) {
+	bs := sig.BlockSize
+	fullBlocks := make(map[uint32][]int)
+	for i, block := range sig.Blocks {
+		if int64(i+1)*int64(bs) <= sig.Size {
+			fullBlocks[block.Weak] = append(fullBlocks[block.Weak], i)
+		}
+	}
+	lastLen := int(sig.Size % int64(bs))
+	br := bufio.NewReader(r)
+	d := &deltaBuilder{maxLiteral: maxLiteral}
+	window := make([]byte, 0, 2*bs)
+
+	fill := func() error {
+		for len(window) < bs {
+			c, err := br.ReadByte()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			window = append(window, c)
+		}
+		return nil
+	}
+	if err := fill(); err != nil {
+		return nil, err
+	}
+	a, b := weakSum(window)
+	for len(window) == bs {
+		matched := -1
+		for _, i := range fullBlocks[a|b<<16] {
+			if sig.Blocks[i].Strong == strongSum(window) {
+				matched = i
+				break
+			}
+		}
+		if matched >= 0 {
+			d.addCopy(matched)
+			window = window[:0]
+			if err := fill(); err != nil {
+				return nil, err
+			}
+			a, b = weakSum(window)
+			continue
+		}
+		out := window[0]
+		if err := d.addLiteral(out); err != nil {
+			return nil, err
+		}
+		in, err := br.ReadByte()
+		if err == io.EOF {
+			window = window[1:]
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Roll the checksum one byte forward
+		a = (a - uint32(out) + uint32(in)) & 0xffff
+		b = (b - uint32(bs)*uint32(out) + a) & 0xffff
+		window = append(window[1:], in)
+	}
+	// Trailing bytes can only match the short final block of the base
+	for len(window) > 0 {
+		if lastLen > 0 && len(window) == lastLen && sig.Blocks[len(sig.Blocks)-1].Strong == strongSum(window) {
+			d.addCopy(len(sig.Blocks) - 1)
+			break
+		}
+		if err := d.addLiteral(window[0]); err != nil {
+			return nil, err
+		}
+		window = window[1:]
+	}
+	d.flushLiteral()
+	return d.ops, nil
+}
+
+// ApplyDelta rebuilds content from base and ops, writing the result to w
+func ApplyDelta(base io.ReaderAt, blockSize int, ops []DeltaOp, w io.Writer) error {
+	for _, op := range ops {
+		if op.Data != nil {
+			if _, err := w.Write(op.Data); err != nil {
+				return err
+			}
+			continue
+		}
+		section := io.NewSectionReader(base, int64(op.Block)*int64(blockSize), int64(op.Count)*int64(blockSize))
+		n, err := io.Copy(w, section)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("delta references block %d beyond end of base", op.Block)
+		}
+	}
+	return nil
+}
+
+// ApplyDeltaFile rebuilds content from the file at basePath and ops into a temp file, which is
+// returned once its hash matches wantHash
+func ApplyDeltaFile(basePath string, blockSize int, ops []DeltaOp, syncDir, wantHash string) (string, error) {
+	base, err := os.Open(basePath)
+	if err != nil {
+		return "", err
+	}
+	defer base.Close()
+	out, err := os.CreateTemp(TempDir(syncDir), "delta-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file for delta: %w", err)
+	}
+	hash := sha256.New()
+	err = ApplyDelta(base, blockSize, ops, io.MultiWriter(out, hash))
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); err == nil && got != wantHash {
+		err = fmt.Errorf("delta result hash mismatch: got %s, want %s", got, wantHash)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	base := randomBytes(1, 100*1024+123)
+	bs := blockSizeFor(int64(len(base)))
+	tests := []struct {
+		name string
+		base []byte
+		next []byte
+		// maxLiteral is the most literal data the delta may carry, -1 for no check
+		maxLiteral int
+	}{
+		{"both empty", nil, nil, 0},
+		{"empty base", nil, []byte("new content"), -1},
+		{"emptied", base, nil, 0},
+		{"identical", base, base, 0},
+		{"shifted by an insert at the start", base, concat([]byte("prefix"), base), len("prefix")},
+		{"shifted by a removal at the start", base, base[7:], bs},
+		// The base's short final block only matches at the very end, so it is resent
+		{"appended", base, concat(base, []byte("suffix")), len(base)%bs + len("suffix")},
+		{"truncated", base, base[:len(base)-500], bs},
+		{"changed in the middle", base, concat(base[:50000], []byte("edit"), base[50004:]), 2 * bs},
+		{"blocks reordered", base, concat(base[bs*10:bs*20], base[:bs*10], base[bs*20:]), 0},
+		{"short base", []byte("tiny"), []byte("tiny and more"), -1},
+		{"unrelated", base, randomBytes(2, 4096), -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := ComputeSignature(bytes.NewReader(tt.base), int64(len(tt.base)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sig.Hash != HashBytes(tt.base) {
+				t.Errorf("signature hash = %s, want %s", sig.Hash, HashBytes(tt.base))
+			}
+			ops, err := ComputeDelta(sig, bytes.NewReader(tt.next), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			literal := 0
+			for _, op := range ops {
+				literal += len(op.Data)
+			}
+			if tt.maxLiteral >= 0 && literal > tt.maxLiteral {
+				t.Errorf("delta carries %d literal bytes, want at most %d", literal, tt.maxLiteral)
+			}
+			var out bytes.Buffer
+			if err := ApplyDelta(bytes.NewReader(tt.base), sig.BlockSize, ops, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.next) {
+				t.Errorf("round trip produced %d bytes, want %d", out.Len(), len(tt.next))
+			}
+		})
+	}
+}
+
+func TestComputeDeltaLiteralLimit(t *testing.T) {
+	base := randomBytes(1, 64*1024)
+	sig, err := ComputeSignature(bytes.NewReader(base), int64(len(base)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ComputeDelta(sig, bytes.NewReader(randomBytes(2, len(base))), 1024); !errors.Is(err, ErrDeltaTooLarge) {
+		t.Errorf("unrelated content: got %v, want ErrDeltaTooLarge", err)
+	}
+	if _, err := ComputeDelta(sig, bytes.NewReader(concat(base, []byte("suffix"))), 1024); err != nil {
+		t.Errorf("small append: got %v, want no error", err)
+	}
+}
+
+func TestApplyDeltaBeyondBase(t *testing.T) {
+	ops := []DeltaOp{{Block: 5, Count: 1}}
+	if err := ApplyDelta(bytes.NewReader([]byte("short")), minBlockSize, ops, &bytes.Buffer{}); err == nil {
+		t.Error("copy past the end of the base succeeded")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package common
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// SyncDir flushes the entries of dir to disk, so a rename into it survives a crash. Filesystems
+// that can't sync directories report EINVAL, which is not an error here.
+func SyncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		return nil
+	}
+	return err
+}
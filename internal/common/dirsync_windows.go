@@ -0,0 +1,8 @@
+//go:build windows
+
+package common
+
+// SyncDir is a no-op on Windows, where directories can't be synced and renames are journaled by NTFS
+func SyncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,225 @@
+package common
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// IgnoreFileName is the file holding gitignore-style patterns for its directory and everything
+// below it; it is synced like any other file so every peer shares the same rules
+const IgnoreFileName = ".entangleignore"
+
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// PathIgnorer decides which paths are left out of syncing, following gitignore semantics for
+// the --ignore patterns and every ignore file in the tree
+type PathIgnorer struct {
+	root string
+	// flagRules apply from the root with the lowest precedence
+	flagRules []ignoreRule
+	mu        sync.RWMutex
+	// fileRules are the rules of each ignore file, keyed by its directory in slash form ("" for the root)
+	fileRules map[string][]ignoreRule
+}
+
+// NewPathIgnorer builds an ignorer from comma-separated patterns and loads the ignore files under root
+func NewPathIgnorer(root, ignoreStr string) *PathIgnorer {
+	pi := &PathIgnorer{root: root, fileRules: make(map[string][]ignoreRule)}
+	if ignoreStr != "" {
+		pi.flagRules = parseIgnoreRules(strings.Split(ignoreStr, ","), "--ignore")
+	}
+	pi.load()
+	return pi
+}
+
+// load reads every ignore file outside ignored directories, parents before children so a
+// directory's own rules are known before its contents are checked
+func (pi *PathIgnorer) load() {
+	filepath.WalkDir(pi.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(pi.root, path)
+		if err != nil {
+			return nil
+		}
+		if relPath != "." && pi.IsIgnored(relPath) {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, IgnoreFileName)); err == nil {
+			pi.Reload(filepath.Join(relPath, IgnoreFileName))
+		}
+		return nil
+	})
+}
+
+// Reload re-reads the ignore file at relPath, forgetting its rules if it no longer exists
+func (pi *PathIgnorer) Reload(relPath string) {
+	dir := filepath.ToSlash(filepath.Dir(relPath))
+	if dir == "." {
+		dir = ""
+	}
+	file, err := os.Open(filepath.Join(pi.root, relPath))
+	if err != nil {
+		pi.mu.Lock()
+		delete(pi.fileRules, dir)
+		pi.mu.Unlock()
+		return
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	rules := parseIgnoreRules(lines, relPath)
+	log.Info().Str("path", relPath).Int("rules", len(rules)).Msg("Loaded ignore file")
+	pi.mu.Lock()
+	pi.fileRules[dir] = rules
+	pi.mu.Unlock()
+}
+
+func (pi *PathIgnorer) IsIgnored(path string) bool {
+	if path == StateDirName || strings.HasPrefix(path, StateDirName+string(filepath.Separator)) || IsAtomicTemp(path) {
+		return true
+	}
+	pi.mu.RLock()
+	defer pi.mu.RUnlock()
+	// Nothing inside an ignored directory can be included again, so every parent is checked first
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i := 1; i < len(parts); i++ {
+		if pi.matches(parts[:i], func() bool { return true }) {
+			return true
+		}
+	}
+	return pi.matches(parts, func() bool {
+		info, err := os.Lstat(filepath.Join(pi.root, path))
+		return err == nil && info.IsDir()
+	})
+}
+
+// matches applies the rules for the path made of parts, the last matching rule deciding
+func (pi *PathIgnorer) matches(parts []string, isDir func() bool) bool {
+	ignored := false
+	apply := func(rules []ignoreRule, relPath string) {
+		for _, rule := range rules {
+			if rule.pattern.MatchString(relPath) && (!rule.dirOnly || isDir()) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	path := strings.Join(parts, "/")
+	apply(pi.flagRules, path)
+	apply(pi.fileRules[""], path)
+	// Ignore files deeper in the tree take precedence over those above them
+	for i := 1; i < len(parts); i++ {
+		if rules, ok := pi.fileRules[strings.Join(parts[:i], "/")]; ok {
+			apply(rules, strings.Join(parts[i:], "/"))
+		}
+	}
+	return ignored
+}
+
+// parseIgnoreRules compiles gitignore-style lines, skipping blanks, comments and invalid patterns
+func parseIgnoreRules(lines []string, source string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// Patterns with a slash other than a trailing one are relative to the ignore file's
+		// directory; others match a name at any depth below it
+		expr := globRegexp(strings.TrimPrefix(line, "/"))
+		if !strings.Contains(line, "/") {
+			expr = "(?:.*/)?" + expr
+		}
+		pattern, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			log.Warn().Err(err).Str("source", source).Str("pattern", line).Msg("Skipping invalid ignore pattern")
+			continue
+		}
+		rule.pattern = pattern
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// globRegexp translates a slash-separated glob with gitignore's ** forms into a regular expression
+func globRegexp(glob string) string {
+	var b strings.Builder
+	segments := strings.Split(glob, "/")
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch {
+		case segment == "**" && last:
+			b.WriteString(".*")
+		case segment == "**":
+			b.WriteString("(?:.*/)?")
+		default:
+			writeGlobSegment(&b, segment)
+			if !last {
+				b.WriteByte('/')
+			}
+		}
+	}
+	return b.String()
+}
+
+func writeGlobSegment(b *strings.Builder, segment string) {
+	for i := 0; i < len(segment); i++ {
+		switch segment[i] {
+		case '*':
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '\\':
+			if i+1 < len(segment) {
+				i++
+				b.WriteString(regexp.QuoteMeta(segment[i : i+1]))
+			}
+		case '[':
+			end := strings.IndexByte(segment[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := segment[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(segment[i : i+1]))
+		}
+	}
+}
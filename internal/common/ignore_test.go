@@ -0,0 +1,125 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathIgnorer(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags string
+		// files are ignore files by the directory holding them
+		files map[string]string
+		dirs  []string
+		paths map[string]bool
+	}{
+		{
+			name:  "flag patterns match at any depth",
+			flags: "*.log,tmp",
+			paths: map[string]bool{"a.log": true, "dir/b.log": true, "a.txt": false, "dir/tmp": true, "dir/tmp/x": true, "tmpfile": false},
+		},
+		{
+			name:  "negation re-includes",
+			files: map[string]string{"": "*.log\n!keep.log\n"},
+			paths: map[string]bool{"x.log": true, "keep.log": false, "dir/keep.log": false, "dir/x.log": true},
+		},
+		{
+			name:  "last matching rule wins",
+			files: map[string]string{"": "!keep.log\n*.log\n"},
+			paths: map[string]bool{"keep.log": true},
+		},
+		{
+			name:  "nothing inside an ignored directory is re-included",
+			files: map[string]string{"": "build/\n!build/keep.txt\n"},
+			dirs:  []string{"build"},
+			paths: map[string]bool{"build": true, "build/keep.txt": true, "build/sub/x": true},
+		},
+		{
+			name:  "leading slash anchors to the ignore file",
+			files: map[string]string{"": "/top.txt\n"},
+			paths: map[string]bool{"top.txt": true, "dir/top.txt": false},
+		},
+		{
+			name:  "inner slash anchors to the ignore file",
+			files: map[string]string{"": "docs/*.md\n"},
+			paths: map[string]bool{"docs/a.md": true, "docs/sub/a.md": false, "x/docs/a.md": false},
+		},
+		{
+			name:  "trailing slash matches directories only",
+			files: map[string]string{"": "cache/\n"},
+			dirs:  []string{"cache", "dir/cache"},
+			paths: map[string]bool{"cache": true, "cache/x": true, "dir/cache": true, "file/cache": false},
+		},
+		{
+			name:  "double star",
+			files: map[string]string{"": "a/**/b\nlogs/**\n**/gen\n"},
+			paths: map[string]bool{"a/b": true, "a/x/y/b": true, "a/bb": false, "logs/x/y": true, "logs": false, "gen": true, "x/y/gen": true},
+		},
+		{
+			name:  "wildcards, classes and escapes",
+			files: map[string]string{"": "?.txt\n[ab].md\n[!c].go\n\\!bang\n\\#hash\n# comment\n\n"},
+			paths: map[string]bool{"x.txt": true, "xy.txt": false, "a.md": true, "c.md": false, "d.go": true, "c.go": false, "!bang": true, "#hash": true, "# comment": false},
+		},
+		{
+			name: "deeper ignore files take precedence",
+			files: map[string]string{
+				"":    "*.log\n",
+				"sub": "!*.log\n/only.txt\n",
+			},
+			paths: map[string]bool{"a.log": true, "other/a.log": true, "sub/a.log": false, "sub/deep/a.log": false, "sub/only.txt": true, "sub/deep/only.txt": false, "only.txt": false},
+		},
+		{
+			name:  "state directory and temp files are always ignored",
+			flags: "!*",
+			paths: map[string]bool{StateDirName: true, StateDirName + "/journal.json": true, "dir/" + atomicTempPrefix + "x": true, "file": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for dir, rules := range tt.files {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(root, dir, IgnoreFileName), []byte(rules), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ignorer := NewPathIgnorer(root, tt.flags)
+			for path, want := range tt.paths {
+				if got := ignorer.IsIgnored(filepath.FromSlash(path)); got != want {
+					t.Errorf("IsIgnored(%q) = %v, want %v", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPathIgnorerReload(t *testing.T) {
+	root := t.TempDir()
+	ignorer := NewPathIgnorer(root, "")
+	if ignorer.IsIgnored("a.log") {
+		t.Fatal("a.log ignored without rules")
+	}
+	if err := os.WriteFile(filepath.Join(root, IgnoreFileName), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ignorer.Reload(IgnoreFileName)
+	if !ignorer.IsIgnored("a.log") {
+		t.Error("a.log not ignored after the ignore file was added")
+	}
+	if err := os.Remove(filepath.Join(root, IgnoreFileName)); err != nil {
+		t.Fatal(err)
+	}
+	ignorer.Reload(IgnoreFileName)
+	if ignorer.IsIgnored("a.log") {
+		t.Error("a.log still ignored after the ignore file was removed")
+	}
+}
@@ -0,0 +1,168 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const indexFileName = "index.json"
+
+// racyWindow is how recently a file may have been modified for its hash to not be reused, as a
+// write landing within the same mtime tick as the hashing would go unnoticed
+const racyWindow = 2 * time.Second
+
+type indexEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode,omitempty"`
+	Hash    string `json:"hash"`
+}
+
+// Index caches the hash of every file under a sync directory along with the stat info it was
+// computed from, so unchanged files are not read again across connections and restarts
+type Index struct {
+	mu      sync.Mutex
+	root    string
+	path    string
+	entries map[string]indexEntry
+	dirty   bool
+}
+
+// LoadIndex reads the index of syncDir, starting empty if there is none or it can't be parsed
+func LoadIndex(syncDir string) (*Index, error) {
+	ix := &Index{
+		root:    syncDir,
+		path:    filepath.Join(syncDir, StateDirName, indexFileName),
+		entries: make(map[string]indexEntry),
+	}
+	data, err := os.ReadFile(ix.path)
+	if os.IsNotExist(err) {
+		return ix, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file index: %w", err)
+	}
+	if err := json.Unmarshal(data, &ix.entries); err != nil || ix.entries == nil {
+		// Only a cache, so it is rebuilt rather than refusing to start
+		ix.entries = make(map[string]indexEntry)
+	}
+	return ix, nil
+}
+
+// State returns EntryState of fullPath, reusing the indexed hash of regular files whose size,
+// mtime and inode are unchanged
+func (ix *Index) State(fullPath string, info os.FileInfo) (string, error) {
+	if !info.Mode().IsRegular() {
+		return EntryState(fullPath, info)
+	}
+	relPath, err := filepath.Rel(ix.root, fullPath)
+	if err != nil {
+		return "", err
+	}
+	current := statEntry(info)
+	ix.mu.Lock()
+	entry, ok := ix.entries[relPath]
+	ix.mu.Unlock()
+	if ok && entry.Size == current.Size && entry.ModTime == current.ModTime && entry.Inode == current.Inode {
+		return entry.Hash, nil
+	}
+	hash, err := ComputeFileHash(fullPath)
+	if err != nil {
+		return "", err
+	}
+	ix.Put(fullPath, info, hash)
+	return hash, nil
+}
+
+// Put records hash as the content of fullPath as of info
+func (ix *Index) Put(fullPath string, info os.FileInfo, hash string) {
+	relPath, err := filepath.Rel(ix.root, fullPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if time.Since(info.ModTime()) < racyWindow {
+		if _, ok := ix.entries[relPath]; ok {
+			delete(ix.entries, relPath)
+			ix.dirty = true
+		}
+		return
+	}
+	entry := statEntry(info)
+	entry.Hash = hash
+	if ix.entries[relPath] != entry {
+		ix.entries[relPath] = entry
+		ix.dirty = true
+	}
+}
+
+// DeleteTree forgets path and everything below it
+func (ix *Index) DeleteTree(path string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	prefix := path + string(filepath.Separator)
+	for p := range ix.entries {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(ix.entries, p)
+			ix.dirty = true
+		}
+	}
+}
+
+// MoveTree re-keys path and everything below it to newPath, as a rename keeps size, mtime and inode
+func (ix *Index) MoveTree(path, newPath string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	moved := make(map[string]indexEntry)
+	for p, entry := range ix.entries {
+		if target, ok := RebasePath(p, path, newPath); ok {
+			delete(ix.entries, p)
+			moved[target] = entry
+		}
+	}
+	for p, entry := range moved {
+		ix.entries[p] = entry
+		ix.dirty = true
+	}
+}
+
+// Retain forgets every path not in keep
+func (ix *Index) Retain(keep map[string]string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for p := range ix.entries {
+		if _, ok := keep[p]; !ok {
+			delete(ix.entries, p)
+			ix.dirty = true
+		}
+	}
+}
+
+// Flush saves the index if it changed since the last save
+func (ix *Index) Flush() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if !ix.dirty {
+		return nil
+	}
+	data, err := json.Marshal(ix.entries)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(ix.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write file index: %w", err)
+	}
+	ix.dirty = false
+	return nil
+}
+
+func statEntry(info os.FileInfo) indexEntry {
+	inode, _ := FileID(info)
+	return indexEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Inode: inode}
+}
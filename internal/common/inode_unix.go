@@ -0,0 +1,17 @@
+//go:build !windows
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileID returns the inode of info, which stays the same across renames
+func FileID(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Ino), true
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// TreeRoot is the directory key of the sync root in a manifest tree
+const TreeRoot = "."
+
+// TreeEntry is one child of a directory in a manifest tree
+type TreeEntry struct {
+	Path  string `json:"path"`
+	State string `json:"state"`
+	// Hash covers the state and metadata of a file, or everything below a directory
+	Hash string `json:"hash"`
+	FileMeta
+}
+
+// ManifestTree arranges a manifest by directory with a hash of every subtree, so two trees can
+// be compared from the root down, skipping every subtree whose hashes match
+type ManifestTree struct {
+	entries  map[string]TreeEntry
+	children map[string][]string
+	root     string
+}
+
+// NewManifestTree builds the tree of a manifest
+func NewManifestTree(m *ManifestMessage) *ManifestTree {
+	t := &ManifestTree{entries: make(map[string]TreeEntry), children: make(map[string][]string)}
+	for path, state := range m.States() {
+		t.entries[path] = TreeEntry{Path: path, State: state, FileMeta: m.Meta[path]}
+		parent := filepath.Dir(path)
+		t.children[parent] = append(t.children[parent], path)
+	}
+	for _, paths := range t.children {
+		sort.Strings(paths)
+	}
+	t.root = t.hash(TreeRoot)
+	return t
+}
+
+// hash fills in the hash of path and everything below it
+func (t *ManifestTree) hash(path string) string {
+	entry, ok := t.entries[path]
+	if ok && entry.State != StateDir {
+		entry.Hash = HashBytes(fmt.Appendf(nil, "%s\x00%o\x00%d", entry.State, entry.Mode, entry.ModTime))
+		t.entries[path] = entry
+		return entry.Hash
+	}
+	h := sha256.New()
+	for _, child := range t.children[path] {
+		fmt.Fprintf(h, "%s\x00%s\n", filepath.Base(child), t.hash(child))
+	}
+	entry.Hash = hex.EncodeToString(h.Sum(nil))
+	if ok {
+		t.entries[path] = entry
+	}
+	return entry.Hash
+}
+
+// Root returns the hash of the whole tree
+func (t *ManifestTree) Root() string {
+	return t.root
+}
+
+// Entry returns the entry at path
+func (t *ManifestTree) Entry(path string) (TreeEntry, bool) {
+	entry, ok := t.entries[path]
+	return entry, ok
+}
+
+// Listing returns the children of dir
+func (t *ManifestTree) Listing(dir string) []TreeEntry {
+	listing := make([]TreeEntry, 0, len(t.children[dir]))
+	for _, path := range t.children[dir] {
+		listing = append(listing, t.entries[path])
+	}
+	return listing
+}
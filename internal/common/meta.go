@@ -0,0 +1,58 @@
+package common
+
+import (
+	"os"
+	"runtime"
+	"time"
+)
+
+// FileMeta is the metadata synced along with content. Zero values mean unknown and are left alone
+// by receivers, which covers older peers and Windows, where permission bits don't carry over.
+type FileMeta struct {
+	Mode    uint32 `json:"mode,omitempty"`  // permission bits
+	ModTime int64  `json:"mtime,omitempty"` // unix nanoseconds, files only
+}
+
+// MetaOf returns the syncable metadata of a file or directory
+func MetaOf(info os.FileInfo) FileMeta {
+	var meta FileMeta
+	if runtime.GOOS != "windows" {
+		meta.Mode = uint32(info.Mode().Perm())
+	}
+	if !info.IsDir() {
+		// Directory times change with every entry written into them, so they aren't synced
+		meta.ModTime = info.ModTime().UnixNano()
+	}
+	return meta
+}
+
+// Perm returns the permissions to write fullPath with: the synced mode if known, otherwise those
+// of the file being replaced, or 0644 for a new file
+func (m FileMeta) Perm(fullPath string) os.FileMode {
+	if m.Mode != 0 {
+		return os.FileMode(m.Mode).Perm()
+	}
+	if info, err := os.Stat(fullPath); err == nil {
+		return info.Mode().Perm()
+	}
+	return 0644
+}
+
+// Apply sets the known parts of m on fullPath. Only permission bits are applied, never setuid and the like.
+func (m FileMeta) Apply(fullPath string) error {
+	if m.Mode != 0 {
+		if err := os.Chmod(fullPath, os.FileMode(m.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if m.ModTime != 0 {
+		// A zero access time is left unchanged
+		return os.Chtimes(fullPath, time.Time{}, time.Unix(0, m.ModTime))
+	}
+	return nil
+}
+
+// Differs reports whether applying m to a path with local metadata would change anything
+func (m FileMeta) Differs(local FileMeta) bool {
+	return (m.Mode != 0 && local.Mode != 0 && m.Mode != local.Mode) || (m.ModTime != 0 && m.ModTime != local.ModTime)
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrInvalidPath = errors.New("invalid path")
+
+// Device names that can't be used as file names on Windows, with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ValidatePath checks that a path received from a peer is a clean relative path that stays inside
+// the sync root on every platform. Both separators are checked so Windows peers are covered too.
+func ValidatePath(path string) error {
+	if path == "" {
+		return fmt.Errorf("%w: empty path", ErrInvalidPath)
+	}
+	if strings.ContainsRune(path, 0) {
+		return fmt.Errorf("%w: %q contains a NUL byte", ErrInvalidPath, path)
+	}
+	if isAbsolute(path) {
+		return fmt.Errorf("%w: %q is absolute", ErrInvalidPath, path)
+	}
+	parts := strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' })
+	if len(parts) == 0 || parts[0] == StateDirName {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidPath, path)
+	}
+	for _, part := range parts {
+		if part == ".." {
+			return fmt.Errorf("%w: %q escapes the sync directory", ErrInvalidPath, path)
+		}
+		if part == "." {
+			return fmt.Errorf("%w: %q is not clean", ErrInvalidPath, path)
+		}
+		base, _, _ := strings.Cut(part, ".")
+		if reservedNames[strings.ToUpper(base)] {
+			return fmt.Errorf("%w: %q uses the reserved name %s", ErrInvalidPath, path, part)
+		}
+	}
+	return nil
+}
+
+// RebasePath moves path from under oldPrefix to under newPrefix, reporting false if path is not
+// oldPrefix itself or below it
+func RebasePath(path, oldPrefix, newPrefix string) (string, bool) {
+	if path == oldPrefix {
+		return newPrefix, true
+	}
+	if rest, ok := strings.CutPrefix(path, oldPrefix+string(filepath.Separator)); ok {
+		return filepath.Join(newPrefix, rest), true
+	}
+	return "", false
+}
+
+// isAbsolute reports whether path is absolute on any platform
+func isAbsolute(path string) bool {
+	return filepath.IsAbs(path) || filepath.VolumeName(path) != "" || strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\`) || hasDriveLetter(path)
+}
+
+func hasDriveLetter(path string) bool {
+	return len(path) >= 2 && path[1] == ':' && ('a' <= path[0] && path[0] <= 'z' || 'A' <= path[0] && path[0] <= 'Z')
+}
+
+// SafeJoin validates path and joins it to root, refusing paths that would leave root through a
+// symlinked directory or a symlink at the path itself
+func SafeJoin(root, path string) (string, error) {
+	if err := ValidatePath(path); err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	root = filepath.Clean(root)
+	fullPath := filepath.Join(root, path)
+	// Only the part of the path that already exists can contain symlinks
+	existing := fullPath
+	for existing != root {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q contains an unresolvable symlink", ErrInvalidPath, path)
+	}
+	if rel, err := filepath.Rel(realRoot, resolved); err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+		return "", fmt.Errorf("%w: %q resolves outside the sync directory", ErrInvalidPath, path)
+	}
+	return fullPath, nil
+}
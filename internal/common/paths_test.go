@@ -0,0 +1,96 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidatePath(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"file.txt", true},
+		{"dir/sub/file.txt", true},
+		{"dir/..file", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{`\share\file`, false},
+		{"C:file", false},
+		{`C:\file`, false},
+		{"..", false},
+		{"../file", false},
+		{"dir/../../file", false},
+		{`dir\..\..\file`, false},
+		{"./file", false},
+		{"dir/./file", false},
+		{"a\x00b", false},
+		{StateDirName, false},
+		{StateDirName + "/journal.json", false},
+		{"dir/" + StateDirName, true},
+		{"CON", false},
+		{"dir/nul.txt", false},
+		{"console", true},
+	}
+	for _, tt := range tests {
+		err := ValidatePath(tt.path)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidatePath(%q) = %v, want ok %v", tt.path, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("ValidatePath(%q) = %v, want ErrInvalidPath", tt.path, err)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{"dir", "dir/sub"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"out":           outside,
+		"dir/up":        "..",
+		"dir/escape":    "../..",
+		"outfile":       filepath.Join(outside, "file"),
+		"dir/dangling":  "missing",
+		"dir/subinside": "sub",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"file.txt", true},
+		{"dir/sub/new/file.txt", true},
+		{"dir/up/file.txt", true},
+		{"dir/subinside/file.txt", true},
+		{"../file", false},
+		{"/etc/passwd", false},
+		{"out", false},
+		{"out/file.txt", false},
+		{"out/new/file.txt", false},
+		{"dir/escape/file.txt", false},
+		{"outfile", false},
+		{"dir/dangling", false},
+	}
+	for _, tt := range tests {
+		fullPath, err := SafeJoin(root, tt.path)
+		if (err == nil) != tt.ok {
+			t.Errorf("SafeJoin(%q) = %q, %v, want ok %v", tt.path, fullPath, err, tt.ok)
+			continue
+		}
+		if err == nil && fullPath != filepath.Join(root, tt.path) {
+			t.Errorf("SafeJoin(%q) = %q, want %q", tt.path, fullPath, filepath.Join(root, tt.path))
+		}
+	}
+}
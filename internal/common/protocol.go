@@ -0,0 +1,64 @@
+package common
+
+import "slices"
+
+// Version of the binary, set at build time with
+// -ldflags "-X github.com/tanq16/fs-entangle/internal/common.Version=v1.2"
+var Version = "dev"
+
+const (
+	// ProtocolVersion is the newest protocol this build speaks. Version 1 is the original
+	// protocol without a handshake, still spoken to peers that negotiate no subprotocol.
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+	LegacyProtocol     = 1
+)
+
+type Capability string
+
+const (
+	CapDelta       Capability = "delta"
+	CapChunked     Capability = "chunked"
+	CapCompression Capability = "compression"
+	CapRename      Capability = "rename"
+	CapMetadata    Capability = "metadata"
+	CapSymlinks    Capability = "symlinks"
+	CapTree        Capability = "tree"
+	CapOpLog       Capability = "oplog"
+	CapAcks        Capability = "acks"
+)
+
+// SupportedCapabilities lists the optional features this build can use
+var SupportedCapabilities = []Capability{CapDelta, CapChunked, CapCompression, CapRename, CapMetadata, CapSymlinks, CapTree, CapOpLog, CapAcks}
+
+type Capabilities []Capability
+
+func (c Capabilities) Has(capability Capability) bool {
+	return slices.Contains(c, capability)
+}
+
+// NegotiateCapabilities returns the offered capabilities this build also supports
+func NegotiateCapabilities(offered []Capability) Capabilities {
+	var agreed Capabilities
+	for _, capability := range offered {
+		if slices.Contains(SupportedCapabilities, capability) && !agreed.Has(capability) {
+			agreed = append(agreed, capability)
+		}
+	}
+	return agreed
+}
+
+// ForSymlinks drops the symlinks capability unless links are preserved, as only then are
+// they sent and created as links
+func (c Capabilities) ForSymlinks(mode SymlinkMode) Capabilities {
+	if mode == SymlinksPreserve {
+		return c
+	}
+	return slices.DeleteFunc(slices.Clone(c), func(capability Capability) bool { return capability == CapSymlinks })
+}
+
+// NegotiateProtocol picks the newest version both peers speak, or false if their ranges don't overlap
+func NegotiateProtocol(peerVersion, peerMinVersion int) (int, bool) {
+	version := min(peerVersion, ProtocolVersion)
+	return version, version >= max(peerMinVersion, MinProtocolVersion)
+}
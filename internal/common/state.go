@@ -0,0 +1,126 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Markers used in place of a content hash for non-file states
+const (
+	StateRemoved = ""
+	StateDir     = "<dir>"
+)
+
+// expectationTTL is how long an expected state is kept, well past the settled watcher events of
+// the write that set it
+const expectationTTL = time.Minute
+
+// ExpectedState remembers the state the sync engine last left each path in, so
+// watcher events caused by our own writes can be told apart from real edits.
+type ExpectedState struct {
+	mu     sync.Mutex
+	states map[string]expectation
+	modes  map[string]uint32
+	swept  time.Time
+}
+
+type expectation struct {
+	state string
+	at    time.Time
+}
+
+func NewExpectedState() *ExpectedState {
+	return &ExpectedState{states: make(map[string]expectation), modes: make(map[string]uint32), swept: time.Now()}
+}
+
+func (es *ExpectedState) Set(path, state string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	now := time.Now()
+	es.states[path] = expectation{state: state, at: now}
+	es.sweep(now)
+}
+
+// Matches reports whether the given state is what the sync engine expects for path
+func (es *ExpectedState) Matches(path, state string) bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	expected, ok := es.states[path]
+	return ok && expected.state == state
+}
+
+// sweep drops the expectations that outlived their events, at most once per expectationTTL.
+// Removed paths take the permissions known for them and everything below them along.
+func (es *ExpectedState) sweep(now time.Time) {
+	if now.Sub(es.swept) < expectationTTL {
+		return
+	}
+	es.swept = now
+	removed := make(map[string]bool)
+	for path, expected := range es.states {
+		if now.Sub(expected.at) < expectationTTL {
+			continue
+		}
+		delete(es.states, path)
+		if expected.state == StateRemoved {
+			removed[path] = true
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	for path := range es.modes {
+		for p := path; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+			if removed[p] {
+				delete(es.modes, path)
+				break
+			}
+		}
+	}
+}
+
+// SetMode records the permission bits path is known to have
+func (es *ExpectedState) SetMode(path string, mode uint32) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.modes[path] = mode
+}
+
+// ModeMatches reports whether mode is what path is known to have, so attribute changes that leave
+// the permissions alone (including our own time updates) are not synced. A zero mode always matches.
+func (es *ExpectedState) ModeMatches(path string, mode uint32) bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	expected, ok := es.modes[path]
+	return mode == 0 || (ok && expected == mode)
+}
+
+// ExpectParents marks the parent directories of path that don't exist under root yet as
+// about to be created by the sync engine
+func (es *ExpectedState) ExpectParents(root, path string) {
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(root, dir)); err == nil {
+			return
+		}
+		es.Set(dir, StateDir)
+	}
+}
+
+// ParentRemoved reports whether the sync engine removed an ancestor of path, which covers child events of a removed tree
+func (es *ExpectedState) ParentRemoved(path string) bool {
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if es.Matches(dir, StateRemoved) {
+			return true
+		}
+	}
+	return false
+}
+
+func HashBytes(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
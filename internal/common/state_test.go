@@ -0,0 +1,53 @@
+package common
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpectedStateExpires(t *testing.T) {
+	es := NewExpectedState()
+	es.Set("a", "hash")
+	es.Set("d", StateRemoved)
+	es.SetMode("a", 0644)
+	es.SetMode("d", 0755)
+	es.SetMode(filepath.Join("d", "x"), 0644)
+	es.SetMode("dx", 0644)
+	// Age everything past the TTL, as if the events of these writes were long gone
+	past := time.Now().Add(-2 * expectationTTL)
+	for path, expected := range es.states {
+		expected.at = past
+		es.states[path] = expected
+	}
+	es.swept = past
+	es.Set("b", "hash")
+	tests := []struct {
+		path  string
+		state string
+		match bool
+	}{
+		{"a", "hash", false},
+		{"d", StateRemoved, false},
+		{"b", "hash", true},
+	}
+	for _, tt := range tests {
+		if got := es.Matches(tt.path, tt.state); got != tt.match {
+			t.Errorf("Matches(%q) = %v, want %v", tt.path, got, tt.match)
+		}
+	}
+	modes := []struct {
+		path  string
+		known bool
+	}{
+		{"a", true},
+		{"d", false},
+		{filepath.Join("d", "x"), false},
+		{"dx", true},
+	}
+	for _, tt := range modes {
+		if _, ok := es.modes[tt.path]; ok != tt.known {
+			t.Errorf("mode of %q known = %v, want %v", tt.path, ok, tt.known)
+		}
+	}
+}
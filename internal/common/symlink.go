@@ -0,0 +1,227 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+type SymlinkMode string
+
+const (
+	// SymlinksPreserve syncs links as links, as long as they point inside the sync directory
+	SymlinksPreserve SymlinkMode = "preserve"
+	// SymlinksFollow syncs links as copies of what they point to inside the sync directory
+	SymlinksFollow SymlinkMode = "follow"
+	// SymlinksSkip leaves links out of syncing altogether
+	SymlinksSkip SymlinkMode = "skip"
+)
+
+// stateSymlinkPrefix marks the state of a symlink, which is its target rather than a content hash
+const stateSymlinkPrefix = "<symlink>"
+
+// ErrSymlinkSkipped is returned for links the policy leaves out of syncing
+var ErrSymlinkSkipped = errors.New("symlink skipped")
+
+// SymlinkPolicy decides how the symlinks inside a sync directory are treated
+type SymlinkPolicy struct {
+	Mode     SymlinkMode
+	root     string
+	realRoot string
+}
+
+func NewSymlinkPolicy(root, mode string) (*SymlinkPolicy, error) {
+	switch SymlinkMode(mode) {
+	case SymlinksPreserve, SymlinksFollow, SymlinksSkip:
+	default:
+		return nil, fmt.Errorf("unknown symlink mode %q, expected preserve, follow or skip", mode)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &SymlinkPolicy{Mode: SymlinkMode(mode), root: filepath.Clean(root), realRoot: realRoot}, nil
+}
+
+// SymlinkState returns the state recorded for a symlink pointing to target
+func SymlinkState(target string) string {
+	return stateSymlinkPrefix + target
+}
+
+// LinkTarget returns the target of a symlink state
+func LinkTarget(state string) (string, bool) {
+	return strings.CutPrefix(state, stateSymlinkPrefix)
+}
+
+// ValidateLinkTarget checks that a symlink at path pointing to target stays inside the sync root
+func ValidateLinkTarget(path, target string) error {
+	if target == "" || strings.ContainsRune(target, 0) {
+		return fmt.Errorf("%w: link %q has an invalid target", ErrInvalidPath, path)
+	}
+	if isAbsolute(target) {
+		return fmt.Errorf("%w: link %q points to the absolute path %q", ErrInvalidPath, path, target)
+	}
+	if resolved := filepath.Join(filepath.Dir(path), target); resolved != "." && ValidatePath(resolved) != nil {
+		return fmt.Errorf("%w: link %q points outside the sync directory", ErrInvalidPath, path)
+	}
+	return nil
+}
+
+// Stat returns the info of the entry at fullPath as the policy sees it: the link itself when
+// preserving, its target when following, or ErrSymlinkSkipped for links that are not synced
+func (p *SymlinkPolicy) Stat(fullPath string) (os.FileInfo, error) {
+	info, err := os.Lstat(fullPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return info, err
+	}
+	switch p.Mode {
+	case SymlinksPreserve:
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		relPath, err := filepath.Rel(p.root, fullPath)
+		if err == nil {
+			err = ValidateLinkTarget(relPath, target)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("path", fullPath).Msg("Skipping symlink")
+			return nil, ErrSymlinkSkipped
+		}
+		return info, nil
+	case SymlinksFollow:
+		resolved, err := filepath.EvalSymlinks(fullPath)
+		if err != nil {
+			log.Warn().Err(err).Str("path", fullPath).Msg("Skipping broken symlink")
+			return nil, ErrSymlinkSkipped
+		}
+		if rel, err := filepath.Rel(p.realRoot, resolved); err != nil || !filepath.IsLocal(rel) {
+			log.Warn().Str("path", fullPath).Str("target", resolved).Msg("Skipping symlink that points outside the sync directory")
+			return nil, ErrSymlinkSkipped
+		}
+		return os.Stat(fullPath)
+	}
+	return nil, ErrSymlinkSkipped
+}
+
+// State returns the state of fullPath as the policy sees it; skipped links count as removed
+func (p *SymlinkPolicy) State(fullPath string) (string, error) {
+	info, err := p.Stat(fullPath)
+	if os.IsNotExist(err) || errors.Is(err, ErrSymlinkSkipped) {
+		return StateRemoved, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return EntryState(fullPath, info)
+}
+
+// EntryState returns the state of an entry: the directory marker, the symlink target, or the file hash
+func EntryState(fullPath string, info os.FileInfo) (string, error) {
+	switch {
+	case info.IsDir():
+		return StateDir, nil
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return "", err
+		}
+		return SymlinkState(target), nil
+	}
+	return ComputeFileHash(fullPath)
+}
+
+// Walk walks the tree at root like filepath.Walk, applying the policy to every symlink
+func (p *SymlinkPolicy) Walk(root string, fn filepath.WalkFunc) error {
+	if p.Mode != SymlinksFollow {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if _, err := p.Stat(path); err != nil {
+					return nil
+				}
+			}
+			return fn(path, info, err)
+		})
+	}
+	info, err := p.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	err = p.walkFollowed(root, info, nil, fn)
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkFollowed walks through symlinks; ancestors holds the real paths of the directories above
+// path, so links pointing back up the tree are not descended into again
+func (p *SymlinkPolicy) walkFollowed(path string, info os.FileInfo, ancestors []string, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	if slices.Contains(ancestors, real) {
+		log.Warn().Str("path", path).Msg("Skipping symlink that loops back to a parent directory")
+		return nil
+	}
+	if err := fn(path, info, nil); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if err := fn(path, info, err); err != nil && err != filepath.SkipDir {
+			return err
+		}
+		return nil
+	}
+	ancestors = append(ancestors, real)
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		childInfo, err := p.Stat(child)
+		if errors.Is(err, ErrSymlinkSkipped) {
+			continue
+		}
+		if err != nil {
+			err = fn(child, nil, err)
+		} else {
+			err = p.walkFollowed(child, childInfo, ancestors, fn)
+		}
+		if err == filepath.SkipDir {
+			return nil // Returned for a file, skips the rest of the directory
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateSymlink atomically replaces fullPath with a symlink to target
+func CreateSymlink(fullPath, target string) error {
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create parent directories: %w", err)
+	}
+	tmpPath := filepath.Join(dir, atomicTempPrefix+uuid.NewString())
+	if err := os.Symlink(target, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Files at least this large are streamed in chunks instead of sent in one message
+	StreamThreshold = 4 * 1024 * 1024
+	ChunkSize       = 1024 * 1024
+)
+
+// TempDir holds partially received files; it lives in the state directory so renames stay on one filesystem
+func TempDir(syncDir string) string {
+	return filepath.Join(syncDir, StateDirName, "tmp")
+}
+
+// ResetTempDir removes leftovers of transfers and atomic writes interrupted by a previous run
+func ResetTempDir(syncDir string) error {
+	dir := TempDir(syncDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := removeAtomicTemps(syncDir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// StreamFile sends the file at fullPath as a begin/chunk/commit sequence and returns its hash.
+// Only one chunk is held in memory at a time.
+func StreamFile(fullPath string, begin TransferBeginMessage, send func(MessageType, any) error) (string, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	begin.ID = uuid.NewString()
+	begin.Size = info.Size()
+	if err := send(TypeTransferBegin, begin); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	buf := make([]byte, ChunkSize)
+	var offset int64
+	for {
+		n, readErr := io.ReadFull(file, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			chunk := TransferChunkMessage{ID: begin.ID, Offset: offset, Data: buf[:n]}
+			if err := send(TypeTransferChunk, chunk); err != nil {
+				return "", err
+			}
+			offset += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			send(TypeTransferAbort, TransferAbortMessage{ID: begin.ID, Reason: readErr.Error()})
+			return "", readErr
+		}
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err := send(TypeTransferCommit, TransferCommitMessage{ID: begin.ID, Hash: sum}); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// IncomingTransfer receives a streamed file into a temp file
+type IncomingTransfer struct {
+	Begin   TransferBeginMessage
+	file    *os.File
+	hash    hash.Hash
+	written int64
+}
+
+func NewIncomingTransfer(syncDir string, begin TransferBeginMessage) (*IncomingTransfer, error) {
+	file, err := os.CreateTemp(TempDir(syncDir), "transfer-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file for transfer: %w", err)
+	}
+	return &IncomingTransfer{Begin: begin, file: file, hash: sha256.New()}, nil
+}
+
+func (t *IncomingTransfer) Write(chunk TransferChunkMessage) error {
+	if chunk.Offset != t.written {
+		return fmt.Errorf("out of order chunk at offset %d, expected %d", chunk.Offset, t.written)
+	}
+	if t.written+int64(len(chunk.Data)) > t.Begin.Size {
+		return fmt.Errorf("chunk at offset %d runs past the declared size of %d bytes", chunk.Offset, t.Begin.Size)
+	}
+	if _, err := t.file.Write(chunk.Data); err != nil {
+		return err
+	}
+	t.hash.Write(chunk.Data)
+	t.written += int64(len(chunk.Data))
+	return nil
+}
+
+// Commit flushes the temp file and returns its path once its hash matches the sender's
+func (t *IncomingTransfer) Commit(wantHash string) (string, error) {
+	if err := t.file.Sync(); err != nil {
+		t.Abort()
+		return "", err
+	}
+	if err := t.file.Close(); err != nil {
+		os.Remove(t.file.Name())
+		return "", err
+	}
+	if got := hex.EncodeToString(t.hash.Sum(nil)); got != wantHash {
+		os.Remove(t.file.Name())
+		return "", fmt.Errorf("transfer hash mismatch: got %s, want %s", got, wantHash)
+	}
+	return t.file.Name(), nil
+}
+
+func (t *IncomingTransfer) Abort() {
+	t.file.Close()
+	os.Remove(t.file.Name())
+}
+
+// PlaceFile moves a completed temp file to fullPath with permissions perm, creating parent directories as needed
+func PlaceFile(tmpPath, fullPath string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directories: %w", err)
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(fullPath))
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIncomingTransferWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int64
+		chunks []TransferChunkMessage
+		ok     bool
+	}{
+		{"exact size", 6, []TransferChunkMessage{{Offset: 0, Data: []byte("abc")}, {Offset: 3, Data: []byte("def")}}, true},
+		{"short of size", 6, []TransferChunkMessage{{Offset: 0, Data: []byte("abc")}}, true},
+		{"past size", 4, []TransferChunkMessage{{Offset: 0, Data: []byte("abc")}, {Offset: 3, Data: []byte("def")}}, false},
+		{"empty file", 0, []TransferChunkMessage{{Offset: 0, Data: []byte("a")}}, false},
+		{"out of order", 6, []TransferChunkMessage{{Offset: 3, Data: []byte("def")}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncDir := t.TempDir()
+			if err := os.MkdirAll(TempDir(syncDir), 0755); err != nil {
+				t.Fatal(err)
+			}
+			transfer, err := NewIncomingTransfer(syncDir, TransferBeginMessage{Path: "f", Size: tt.size})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transfer.Abort()
+			for _, chunk := range tt.chunks {
+				if err = transfer.Write(chunk); err != nil {
+					break
+				}
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("Write = %v, want ok %v", err, tt.ok)
+			}
+			if transfer.written > tt.size {
+				t.Errorf("wrote %d bytes past the declared size of %d", transfer.written, tt.size)
+			}
+		})
+	}
+}
@@ -5,9 +5,32 @@ import "encoding/json"
 type MessageType string
 
 const (
+	// Client to Server right after connecting - protocol versions and capabilities
+	TypeHello MessageType = "hello"
+
+	// Server to Client in reply to hello - the negotiated session
+	TypeWelcome MessageType = "welcome"
+
+	// Server to Client in reply to hello - the peer is incompatible and is disconnected
+	TypeReject MessageType = "reject"
+
+	// Either direction - a received path was refused and the message carrying it was dropped
+	TypeInvalidPath MessageType = "invalid_path"
+
 	// Server to Client on connection - list of files and their hashes
 	TypeManifest MessageType = "manifest"
 
+	// Server to Client on connection in place of manifest when both support manifest trees -
+	// the root hash, then the listings of directories the client asks for
+	TypeManifestTree MessageType = "manifest_tree"
+
+	// Server to Client on connection in place of a manifest when the client resumes from a
+	// point still in the operation log - the state of every path changed since
+	TypeResume MessageType = "resume"
+
+	// Client to Server during initial sync - listings of directories whose hashes differ
+	TypeTreeRequest MessageType = "tree_request"
+
 	// Client to Server during initial sync - content for a list of files
 	TypeFileRequest MessageType = "file_request"
 
@@ -18,6 +41,30 @@ const (
 	// Client -> Server - Informs about local change
 	// Server -> Client - Broadcasts change to other clients
 	TypeFileOperation MessageType = "file_operation"
+
+	// Server to Client in reply to an operation carrying an ID - it is on the server's disk,
+	// or nothing had to change
+	TypeAck MessageType = "ack"
+
+	// Server to Client in reply to an operation carrying an ID - it was not applied
+	TypeNack MessageType = "nack"
+
+	// Client to Server before sending a delta - asks for the signature of the server's copy
+	TypeSignatureRequest MessageType = "signature_request"
+
+	// Server to Client - block signature of the server's copy of a file
+	TypeSignature MessageType = "signature"
+
+	// Bidirectional chunked transfer of large files, used in place of
+	// file_content and file_operation messages that would carry the content
+	TypeTransferBegin  MessageType = "transfer_begin"
+	TypeTransferChunk  MessageType = "transfer_chunk"
+	TypeTransferCommit MessageType = "transfer_commit"
+	TypeTransferAbort  MessageType = "transfer_abort"
+
+	// Server to Client - a rename could not be applied on the server, so the client sends the
+	// renamed path in full instead
+	TypeRenameRejected MessageType = "rename_rejected"
 )
 
 type OperationType string
@@ -25,24 +72,106 @@ type OperationType string
 const (
 	OpWrite  OperationType = "write"
 	OpRemove OperationType = "remove"
+	// OpRename moves Path to NewPath, overwriting a file at NewPath
+	OpRename OperationType = "rename"
+	// OpMeta changes the permissions of Path without touching its content
+	OpMeta OperationType = "meta"
 )
 
 type MessageWrapper struct {
 	Type    MessageType     `json:"type"`
 	Payload json.RawMessage `json:"payload"`
+	// Data holds bulk bytes carried outside the payload by the binary codec
+	Data []byte `json:"-"`
+}
+
+type HelloMessage struct {
+	ProtocolVersion    int          `json:"protocol_version"`
+	MinProtocolVersion int          `json:"min_protocol_version"`
+	Version            string       `json:"version"`
+	Capabilities       []Capability `json:"capabilities"`
+	// Resume asks to catch up from an earlier connection instead of receiving a manifest
+	Resume *ResumePoint `json:"resume,omitempty"`
+}
+
+// ResumePoint is how far a client got through the server's operation log
+type ResumePoint struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+	// Pending are paths the client requested and never received
+	Pending []string `json:"pending,omitempty"`
+}
+
+type WelcomeMessage struct {
+	ProtocolVersion int          `json:"protocol_version"`
+	Version         string       `json:"version"`
+	Capabilities    []Capability `json:"capabilities"`
+	ClientID        string       `json:"client_id"`
+	// Epoch identifies the server's operation log; sequence numbers from another epoch mean nothing
+	Epoch string `json:"epoch,omitempty"`
+}
+
+type RejectMessage struct {
+	Reason string `json:"reason"`
+}
+
+type InvalidPathMessage struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type RenameRejectedMessage struct {
+	Path    string `json:"path"`
+	NewPath string `json:"new_path"`
+	Reason  string `json:"reason"`
 }
 
 type ManifestMessage struct {
-	Files map[string]string `json:"files"`
+	Files map[string]string   `json:"files"`
+	Meta  map[string]FileMeta `json:"meta,omitempty"`
+	// Dirs lists every directory, so empty ones are synced too
+	Dirs []string `json:"dirs,omitempty"`
+	// Seq is the last operation the manifest includes
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+type ManifestTreeMessage struct {
+	Root string `json:"root"`
+	Seq  uint64 `json:"seq,omitempty"`
+	// Listings of the requested directories, keyed by directory
+	Listings map[string][]TreeEntry `json:"listings,omitempty"`
+}
+
+type ResumeMessage struct {
+	// Seq is the last operation the catch-up includes
+	Seq uint64 `json:"seq"`
+	// Scopes are the paths changed since the client's resume point, true for those whose whole
+	// subtree may have changed; Manifest holds the current state of everything they cover
+	Scopes   map[string]bool `json:"scopes"`
+	Manifest ManifestMessage `json:"manifest"`
+}
+
+type TreeRequestMessage struct {
+	Dirs []string `json:"dirs"`
 }
 
 type FileRequestMessage struct {
 	Paths []string `json:"paths"`
+	// Signatures of local copies the server may answer with a delta against
+	Signatures map[string]*Signature `json:"signatures,omitempty"`
 }
 
 type FileContentMessage struct {
 	Path    string `json:"path"`
 	Content []byte `json:"content"`
+	// Delta replaces Content when the receiver has the base identified by DeltaBase
+	Delta     []DeltaOp `json:"delta,omitempty"`
+	DeltaBase string    `json:"delta_base,omitempty"`
+	BlockSize int       `json:"block_size,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	// LinkTarget is set instead of content when the path is a symlink
+	LinkTarget string `json:"link_target,omitempty"`
+	FileMeta
 }
 
 type FileOperationMessage struct {
@@ -50,4 +179,91 @@ type FileOperationMessage struct {
 	Path    string        `json:"path"`
 	Content []byte        `json:"content"`
 	IsDir   bool          `json:"is_dir,omitempty"`
+	NewPath string        `json:"new_path,omitempty"`
+	// BaseHash is the state the sender last synced for Path (StateRemoved if it had none);
+	// operations without one are applied unconditionally
+	BaseHash *string `json:"base_hash,omitempty"`
+	// Delta replaces Content when the receiver has the base identified by DeltaBase;
+	// Hash is the hash of the resulting content
+	Delta     []DeltaOp `json:"delta,omitempty"`
+	DeltaBase string    `json:"delta_base,omitempty"`
+	BlockSize int       `json:"block_size,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	// ContentPath is a local file holding the content instead of Content; it never goes over the wire
+	ContentPath string `json:"-"`
+	// LinkTarget makes a write create a symlink to it instead of a file
+	LinkTarget string `json:"link_target,omitempty"`
+	// Seq is the position of the operation in the server's operation log
+	Seq uint64 `json:"seq,omitempty"`
+	// ID makes the server answer the sender with an ack or nack
+	ID string `json:"id,omitempty"`
+	FileMeta
+}
+
+// ContentHash returns the hash of the content the operation writes
+func (op *FileOperationMessage) ContentHash() string {
+	if op.IsDir {
+		return StateDir
+	}
+	if op.LinkTarget != "" {
+		return SymlinkState(op.LinkTarget)
+	}
+	if op.Hash != "" {
+		return op.Hash
+	}
+	return HashBytes(op.Content)
+}
+
+type AckMessage struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Seq is the position of the operation in the server's operation log, zero if nothing changed
+	Seq uint64 `json:"seq,omitempty"`
+	// State is what a write left at the path, which the sender records as synced
+	State string `json:"state,omitempty"`
+}
+
+type NackMessage struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	// Retry is set when the failure may be temporary, like a full disk, so sending again may succeed
+	Retry bool `json:"retry,omitempty"`
+}
+
+type SignatureRequestMessage struct {
+	Path string `json:"path"`
+}
+
+type SignatureMessage struct {
+	Path string `json:"path"`
+	// Signature is nil when the server has no copy of the file
+	Signature *Signature `json:"signature,omitempty"`
+	// ID is the operation whose delta base was stale, which the answer to this signature replaces
+	ID string `json:"id,omitempty"`
+}
+
+type TransferBeginMessage struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Op is the write operation the transfer carries content for; file request replies only
+	// use it for metadata
+	Op *FileOperationMessage `json:"op,omitempty"`
+}
+
+type TransferChunkMessage struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+type TransferCommitMessage struct {
+	ID   string `json:"id"`
+	Hash string `json:"hash"`
+}
+
+type TransferAbortMessage struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
 }
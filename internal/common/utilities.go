@@ -3,34 +3,18 @@ package common
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-type PathIgnorer struct {
-	patterns []string
-}
-
-func NewPathIgnorer(ignoreStr string) *PathIgnorer {
-	if ignoreStr == "" {
-		return &PathIgnorer{patterns: []string{}}
-	}
-	return &PathIgnorer{patterns: strings.Split(ignoreStr, ",")}
-}
-
-func (pi *PathIgnorer) IsIgnored(path string) bool {
-	for _, pattern := range pi.patterns {
-		match, err := filepath.Match(pattern, path)
-		if err == nil && match {
-			return true
-		}
-	}
-	return false
-}
+// StateDirName is the directory at the sync root holding fs-entangle's own bookkeeping; it is never synced
+const StateDirName = ".fs-entangle"
 
 func ComputeFileHash(filePath string) (string, error) {
 	file, err := os.Open(filePath)
@@ -45,9 +29,24 @@ func ComputeFileHash(filePath string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func BuildFileManifest(rootDir string, ignorer *PathIgnorer) (map[string]string, error) {
-	manifest := make(map[string]string)
-	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+// ConflictPath names the copy that keeps a losing edit, e.g. "notes (conflict from laptop 2026-10-16).md"
+func ConflictPath(path, origin string, when time.Time, attempt int) string {
+	ext := filepath.Ext(path)
+	if ext == filepath.Base(path) {
+		ext = "" // dotfiles like .bashrc have no extension
+	}
+	suffix := fmt.Sprintf(" (conflict from %s %s", origin, when.Format(time.DateOnly))
+	if attempt > 1 {
+		suffix += fmt.Sprintf(" %d", attempt)
+	}
+	return strings.TrimSuffix(path, ext) + suffix + ")" + ext
+}
+
+// BuildFileManifest lists every directory below rootDir along with the state and metadata of
+// every file and symlink, only hashing files that changed since they were last indexed
+func BuildFileManifest(rootDir string, ignorer *PathIgnorer, symlinks *SymlinkPolicy, index *Index) (ManifestMessage, error) {
+	manifest := ManifestMessage{Files: make(map[string]string), Meta: make(map[string]FileMeta)}
+	err := symlinks.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -65,15 +64,39 @@ func BuildFileManifest(rootDir string, ignorer *PathIgnorer) (map[string]string,
 			}
 			return nil
 		}
-		if !info.IsDir() {
-			hash, err := ComputeFileHash(path)
-			if err != nil {
-				log.Error().Err(err).Str("path", path).Msg("Failed to compute hash for file")
-				return nil
-			}
-			manifest[relPath] = hash
+		if info.IsDir() {
+			manifest.Dirs = append(manifest.Dirs, relPath)
+			return nil
+		}
+		state, err := index.State(path, info)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Failed to compute hash for file")
+			return nil
+		}
+		manifest.Files[relPath] = state
+		if info.Mode()&os.ModeSymlink == 0 {
+			manifest.Meta[relPath] = MetaOf(info)
 		}
 		return nil
 	})
-	return manifest, err
+	if err != nil {
+		return manifest, err
+	}
+	index.Retain(manifest.Files)
+	if err := index.Flush(); err != nil {
+		log.Warn().Err(err).Msg("Failed to save file index")
+	}
+	return manifest, nil
+}
+
+// States returns the state of every path in the manifest, directories included
+func (m *ManifestMessage) States() map[string]string {
+	states := make(map[string]string, len(m.Files)+len(m.Dirs))
+	for path, state := range m.Files {
+		states[path] = state
+	}
+	for _, dir := range m.Dirs {
+		states[dir] = StateDir
+	}
+	return states
 }
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// WatchTree adds root and every directory below it to watcher. visit is called for every entry,
+// files included; directories it returns false for are neither watched nor descended into.
+func WatchTree(watcher *fsnotify.Watcher, symlinks *SymlinkPolicy, root string, visit func(path string, info os.FileInfo) bool) {
+	symlinks.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !visit(path, info) {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				log.Error().Err(err).Str("path", path).Msg("Failed to add path to watcher")
+			}
+		}
+		return nil
+	})
+}
+
+// UnwatchTree removes the watches on root and every directory below it. Watches follow a moved
+// directory under its old name, so they have to be dropped and re-added after a rename.
+func UnwatchTree(watcher *fsnotify.Watcher, root string) {
+	prefix := root + string(filepath.Separator)
+	for _, path := range watcher.WatchList() {
+		if path == root || strings.HasPrefix(path, prefix) {
+			watcher.Remove(path)
+		}
+	}
+}
+
+// WalkNewTree finds what is already inside dir, a directory that appeared under root like a copied
+// or extracted tree, as it produces no watcher events of its own. It runs once the tree is watched,
+// so entries created meanwhile are either found by the walk or send their own events, which are
+// suppressed as the walk records every entry it finds as expected. send is called for each entry
+// found that isn't ignored or already expected.
+func WalkNewTree(root, dir string, symlinks *SymlinkPolicy, ignorer *PathIgnorer, index *Index, expected *ExpectedState, send func(relPath, fullPath string, info os.FileInfo)) {
+	dirPath := filepath.Join(root, dir)
+	symlinks.Walk(dirPath, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil || fullPath == dirPath {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, fullPath)
+		if err != nil || ignorer.IsIgnored(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Base(relPath) == IgnoreFileName {
+			ignorer.Reload(relPath)
+		}
+		state, err := index.State(fullPath, info)
+		if err != nil || expected.Matches(relPath, state) {
+			return nil
+		}
+		expected.Set(relPath, state)
+		expected.SetMode(relPath, MetaOf(info).Mode)
+		send(relPath, fullPath, info)
+		return nil
+	})
+}
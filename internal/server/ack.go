@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// ack tells the sender of an operation that it is on disk, or that nothing had to change
+func (s *Server) ack(envelope fileOperationEnvelope, seq uint64) {
+	if envelope.opID == "" {
+		return
+	}
+	msg := common.AckMessage{ID: envelope.opID, Path: envelope.op.Path, Seq: seq}
+	if envelope.op.Op == common.OpWrite {
+		msg.State = envelope.op.ContentHash()
+	}
+	s.reply(envelope.senderID, common.TypeAck, msg)
+}
+
+// nack tells the sender of an operation that it was not applied and why
+func (s *Server) nack(senderID, opID, path, reason string, retry bool) {
+	if opID == "" {
+		return
+	}
+	log.Warn().Str("path", path).Str("reason", reason).Str("client_id", senderID).Msg("Operation not applied")
+	s.reply(senderID, common.TypeNack, common.NackMessage{ID: opID, Path: path, Reason: reason, Retry: retry})
+}
+
+// nackError reports an operation that failed to apply, letting the sender retry unless the
+// failure is one that won't go away on its own
+func (s *Server) nackError(envelope fileOperationEnvelope, err error) {
+	retry := !errors.Is(err, fs.ErrPermission) && !errors.Is(err, common.ErrInvalidPath)
+	s.nack(envelope.senderID, envelope.opID, envelope.op.Path, err.Error(), retry)
+}
+
+func (s *Server) reply(senderID string, msgType common.MessageType, payload any) {
+	value, ok := s.clients.Load(senderID)
+	if !ok {
+		return
+	}
+	if err := s.sendMessage(value.(*clientConnection), msgType, payload); err != nil {
+		log.Error().Err(err).Str("client_id", senderID).Msg("Failed to reply to operation")
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// validTokenName keeps identities safe to use in logs and conflict file names
+var validTokenName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// tokenStore maps the SHA-256 of each token to the identity it authenticates, so lookups
+// don't leak token contents through timing
+type tokenStore map[[sha256.Size]byte]string
+
+// loadTokens reads "name:token" lines from path; blank lines and # comments are skipped
+func loadTokens(path string) (tokenStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tokens file: %w", err)
+	}
+	defer file.Close()
+	tokens := make(tokenStore)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(line, ":")
+		name, token = strings.TrimSpace(name), strings.TrimSpace(token)
+		if !ok || token == "" {
+			return nil, fmt.Errorf("tokens file line %d: expected name:token", lineNum)
+		}
+		if !validTokenName.MatchString(name) {
+			return nil, fmt.Errorf("tokens file line %d: name %q may only contain letters, digits, '.', '_' and '-'", lineNum, name)
+		}
+		key := sha256.Sum256([]byte(token))
+		if _, exists := tokens[key]; exists {
+			return nil, fmt.Errorf("tokens file line %d: duplicate token", lineNum)
+		}
+		tokens[key] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("tokens file %s has no tokens", path)
+	}
+	return tokens, nil
+}
+
+// identify returns the identity of the bearer token on the request
+func (t tokenStore) identify(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	name, ok := t[sha256.Sum256([]byte(token))]
+	return name, ok
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// currentState returns the hash of path on disk, or the directory/removed markers
+func (s *Server) currentState(path string) string {
+	hash, err := s.symlinks.State(filepath.Join(s.cfg.SyncDir, path))
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Failed to compute hash for conflict check")
+		return common.StateRemoved
+	}
+	return hash
+}
+
+// isNoop reports whether applying op would leave the path exactly as it is, which also stops echo loops
+func isNoop(op *common.FileOperationMessage, current string) bool {
+	switch {
+	case op.Op == common.OpRemove || op.Op == common.OpMeta:
+		return current == common.StateRemoved
+	case op.IsDir:
+		return current == common.StateDir
+	default:
+		return current == op.ContentHash()
+	}
+}
+
+// hasConflict reports whether op was based on a state other than the current one on disk
+func hasConflict(op *common.FileOperationMessage, current string) bool {
+	if op.BaseHash == nil || op.IsDir {
+		return false
+	}
+	return current != *op.BaseHash
+}
+
+// resolveConflict keeps the server's version at the original path, diverts a conflicting write to a
+// conflict copy that is synced to everyone, and restores the server's version on the sender
+func (s *Server) resolveConflict(envelope fileOperationEnvelope, current string) {
+	op := envelope.op
+	log.Warn().Str("op", string(op.Op)).Str("path", op.Path).Str("client_id", envelope.senderID).Msg("Conflicting operation, base does not match server state")
+	// Sent ahead of the restore, which the sender records as synced
+	s.nack(envelope.senderID, envelope.opID, op.Path, "conflicts with a change on the server", false)
+	if op.Op == common.OpWrite {
+		copyOp := common.FileOperationMessage{
+			Op:          common.OpWrite,
+			Path:        s.conflictCopyPath(op.Path, envelope.senderName),
+			Content:     op.Content,
+			ContentPath: op.ContentPath,
+			Hash:        op.Hash,
+			LinkTarget:  op.LinkTarget,
+			FileMeta:    op.FileMeta,
+		}
+		log.Info().Str("path", copyOp.Path).Msg("Saving conflicting write as a conflict copy")
+		if err := s.applyChangeLocally(&copyOp); err == nil {
+			s.broadcastOperation("", &copyOp)
+		}
+	}
+	if current == common.StateDir {
+		return
+	}
+	restore := common.FileOperationMessage{Op: common.OpRemove, Path: op.Path}
+	if target, isLink := common.LinkTarget(current); isLink {
+		restore.Op = common.OpWrite
+		restore.LinkTarget = target
+	} else if current != common.StateRemoved {
+		restore.Op = common.OpWrite
+		restore.ContentPath = filepath.Join(s.cfg.SyncDir, op.Path)
+		restore.Hash = current
+		if info, err := os.Stat(restore.ContentPath); err == nil {
+			restore.FileMeta = common.MetaOf(info)
+		}
+	}
+	value, ok := s.clients.Load(envelope.senderID)
+	if !ok {
+		return
+	}
+	if err := s.sendOperation(value.(*clientConnection), &restore, nil); err != nil {
+		log.Error().Err(err).Str("client_id", envelope.senderID).Msg("Failed to restore server version on sender")
+	}
+}
+
+func (s *Server) conflictCopyPath(path, origin string) string {
+	now := time.Now()
+	for attempt := 1; ; attempt++ {
+		candidate := common.ConflictPath(path, origin, now, attempt)
+		// Any error means nothing is there, or nothing can be, in which case writing it fails
+		if _, err := os.Lstat(filepath.Join(s.cfg.SyncDir, candidate)); err != nil {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+func (s *Server) handleSignatureRequest(client *clientConnection, wrapper common.MessageWrapper) {
+	var req common.SignatureRequestMessage
+	if err := common.DecodePayload(wrapper, &req); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal signature request")
+		return
+	}
+	if s.ignorer.IsIgnored(req.Path) || !s.checkPath(client, req.Path) {
+		return
+	}
+	s.sendSignature(client, req.Path, "")
+}
+
+// sendSignature sends the block signature of the server's copy of path so the client can answer
+// with a delta, in place of the operation opID if that one's delta was stale
+func (s *Server) sendSignature(client *clientConnection, path, opID string) {
+	msg := common.SignatureMessage{Path: path, ID: opID}
+	s.diskMutex.Lock()
+	sig, err := common.FileSignature(filepath.Join(s.cfg.SyncDir, path))
+	s.diskMutex.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("path", path).Msg("Failed to compute file signature")
+	}
+	if err == nil {
+		msg.Signature = sig
+	}
+	if err := s.sendMessage(client, common.TypeSignature, msg); err != nil {
+		log.Error().Err(err).Str("client_id", client.id).Msg("Failed to send file signature")
+	}
+}
+
+// expandDelta rebuilds the full content of a delta operation from the file on disk. If the file
+// changed since the sender fetched its signature, a fresh signature is sent so it can retry.
+func (s *Server) expandDelta(envelope *fileOperationEnvelope, current string) bool {
+	op := &envelope.op
+	if op.DeltaBase == current {
+		tmpPath, err := common.ApplyDeltaFile(filepath.Join(s.cfg.SyncDir, op.Path), op.BlockSize, op.Delta, s.cfg.SyncDir, op.Hash)
+		if err == nil {
+			op.ContentPath = tmpPath
+			return true
+		}
+		log.Error().Err(err).Str("path", op.Path).Msg("Failed to apply delta")
+		if envelope.opID != "" {
+			// A sender taking acks retries on the nack
+			s.nack(envelope.senderID, envelope.opID, op.Path, err.Error(), true)
+			return false
+		}
+	} else {
+		log.Warn().Str("path", op.Path).Str("client_id", envelope.senderID).Msg("Delta base no longer matches server file, asking sender to retry")
+	}
+	// The sender answers with a new operation, which replaces this one
+	if value, ok := s.clients.Load(envelope.senderID); ok {
+		s.sendSignature(value.(*clientConnection), op.Path, envelope.opID)
+	}
+	return false
+}
+
+// sendFileContent answers a file request with a delta against the client's copy when it has one,
+// a chunked transfer for large files, or the whole content otherwise
+func (s *Server) sendFileContent(client *clientConnection, path string, sig *common.Signature) error {
+	fullPath := filepath.Join(s.cfg.SyncDir, path)
+	info, err := s.symlinks.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !client.caps.Has(common.CapSymlinks) {
+			return nil
+		}
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return err
+		}
+		return s.sendFileContentMessage(client, common.FileContentMessage{Path: path, LinkTarget: target})
+	}
+	meta := common.MetaOf(info)
+	if sig != nil && info.Size() >= common.MinDeltaSize && client.caps.Has(common.CapDelta) {
+		if msg, ok := s.deltaContent(path, sig, info.Size()); ok {
+			msg.FileMeta = meta
+			return s.sendFileContentMessage(client, msg)
+		}
+	}
+	if info.Size() >= common.StreamThreshold && client.caps.Has(common.CapChunked) {
+		begin := common.TransferBeginMessage{Path: path, Op: &common.FileOperationMessage{Op: common.OpWrite, Path: path, FileMeta: meta}}
+		_, err := common.StreamFile(fullPath, begin, func(msgType common.MessageType, payload any) error {
+			return s.sendMessage(client, msgType, payload)
+		})
+		return err
+	}
+	content, err := os.ReadFile(fullPath)
+	if err != nil {
+		return err
+	}
+	return s.sendFileContentMessage(client, common.FileContentMessage{Path: path, Content: content, FileMeta: meta})
+}
+
+func (s *Server) deltaContent(path string, sig *common.Signature, size int64) (common.FileContentMessage, bool) {
+	msg := common.FileContentMessage{Path: path, DeltaBase: sig.Hash, BlockSize: sig.BlockSize}
+	file, err := os.Open(filepath.Join(s.cfg.SyncDir, path))
+	if err != nil {
+		return msg, false
+	}
+	defer file.Close()
+	hash := sha256.New()
+	delta, err := common.ComputeDelta(sig, io.TeeReader(file, hash), common.MaxDeltaLiteral(size))
+	if err != nil {
+		if !errors.Is(err, common.ErrDeltaTooLarge) {
+			log.Error().Err(err).Str("path", path).Msg("Failed to compute delta, sending full content")
+		}
+		return msg, false
+	}
+	msg.Delta = delta
+	msg.Hash = hex.EncodeToString(hash.Sum(nil))
+	return msg, true
+}
+
+func (s *Server) sendFileContentMessage(client *clientConnection, content common.FileContentMessage) error {
+	return s.sendMessage(client, common.TypeFileContent, content)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// handshake negotiates the protocol version and capabilities with a newly connected client
+func (s *Server) handshake(client *clientConnection) error {
+	if client.conn.Subprotocol() == "" {
+		// Clients from before the handshake existed offer no subprotocol and never send hello
+		client.protocol = common.LegacyProtocol
+		log.Warn().Str("client_id", client.id).Msg("Client predates the protocol handshake, using legacy protocol without optional features")
+		return nil
+	}
+	client.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer client.conn.SetReadDeadline(time.Time{})
+	frameType, data, err := client.conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read hello: %w", err)
+	}
+	wrapper, err := client.codec.Decode(frameType, data)
+	if err != nil || wrapper.Type != common.TypeHello {
+		return s.reject(client, "expected hello message")
+	}
+	var hello common.HelloMessage
+	if err := common.DecodePayload(wrapper, &hello); err != nil {
+		return s.reject(client, "malformed hello message")
+	}
+	version, ok := common.NegotiateProtocol(hello.ProtocolVersion, hello.MinProtocolVersion)
+	if !ok {
+		return s.reject(client, fmt.Sprintf("client speaks protocol %d-%d, server speaks %d-%d",
+			hello.MinProtocolVersion, hello.ProtocolVersion, common.MinProtocolVersion, common.ProtocolVersion))
+	}
+	client.protocol = version
+	client.caps = common.NegotiateCapabilities(hello.Capabilities).ForSymlinks(s.symlinks.Mode)
+	if client.caps.Has(common.CapCompression) {
+		client.conn.EnableWriteCompression(true)
+	}
+	log.Info().Str("client_id", client.id).Int("protocol", version).Str("client_version", hello.Version).Interface("capabilities", client.caps).Msg("Handshake complete")
+	welcome := common.WelcomeMessage{
+		ProtocolVersion: version,
+		Version:         common.Version,
+		Capabilities:    client.caps,
+		ClientID:        client.id,
+	}
+	if client.caps.Has(common.CapOpLog) {
+		welcome.Epoch, _ = s.oplog.Position()
+		client.resume = hello.Resume
+	}
+	return s.sendMessage(client, common.TypeWelcome, welcome)
+}
+
+// reject tells the client why it cannot join and closes the connection
+func (s *Server) reject(client *clientConnection, reason string) error {
+	log.Warn().Str("client_id", client.id).Str("reason", reason).Msg("Rejecting client")
+	s.sendMessage(client, common.TypeReject, common.RejectMessage{Reason: reason})
+	client.writeMutex.Lock()
+	client.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(time.Second))
+	client.writeMutex.Unlock()
+	return errors.New(reason)
+}
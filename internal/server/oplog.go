@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+const (
+	opLogFileName = "oplog.json"
+	// opLogSize is how many operations are kept for clients to catch up from
+	opLogSize = 10000
+)
+
+type logEntry struct {
+	Seq     uint64               `json:"seq"`
+	Op      common.OperationType `json:"op"`
+	Path    string               `json:"path"`
+	NewPath string               `json:"new_path,omitempty"`
+}
+
+// opLog numbers every broadcast operation and remembers the most recent ones, so a reconnecting
+// client can catch up on what it missed instead of comparing full manifests
+type opLog struct {
+	mu   sync.Mutex
+	path string
+	// Epoch changes whenever the sequence restarts or the disk may have changed unlogged
+	Epoch string `json:"epoch"`
+	// Root is the manifest tree root at a clean shutdown, empty while the server runs
+	Root    string     `json:"root,omitempty"`
+	Seq     uint64     `json:"seq"`
+	Entries []logEntry `json:"entries"`
+	dirty   bool
+}
+
+// loadOpLog continues the saved log if the directory is exactly as it was at shutdown, and
+// starts a new epoch otherwise, since changes made while the server was down were never logged
+func loadOpLog(syncDir, root string) (*opLog, error) {
+	l := &opLog{path: filepath.Join(syncDir, common.StateDirName, opLogFileName)}
+	data, err := os.ReadFile(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read operation log: %w", err)
+	}
+	if err == nil && json.Unmarshal(data, l) == nil && l.Root != "" && l.Root == root {
+		log.Info().Str("epoch", l.Epoch).Uint64("seq", l.Seq).Msg("Continuing operation log")
+	} else {
+		*l = opLog{path: l.path, Epoch: uuid.NewString()}
+		log.Info().Str("epoch", l.Epoch).Msg("Starting new operation log")
+	}
+	// Saved without a root, so a crash starts a new epoch on the next start
+	l.Root = ""
+	l.dirty = true
+	return l, l.Flush()
+}
+
+// Append assigns op the next sequence number and records it
+func (l *opLog) Append(op *common.FileOperationMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Seq++
+	op.Seq = l.Seq
+	l.Entries = append(l.Entries, logEntry{Seq: l.Seq, Op: op.Op, Path: op.Path, NewPath: op.NewPath})
+	if len(l.Entries) > 2*opLogSize {
+		l.Entries = append([]logEntry(nil), l.Entries[len(l.Entries)-opLogSize:]...)
+	}
+	l.dirty = true
+}
+
+// Position returns the epoch and the last sequence number assigned
+func (l *opLog) Position() (string, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Epoch, l.Seq
+}
+
+// Since returns the paths touched by the operations after seq, true for those whose whole subtree
+// may have changed, or false if the log no longer reaches back that far
+func (l *opLog) Since(epoch string, seq uint64) (map[string]bool, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if epoch != l.Epoch || seq > l.Seq {
+		return nil, false
+	}
+	oldest := l.Seq + 1
+	if len(l.Entries) > 0 {
+		oldest = l.Entries[0].Seq
+	}
+	if seq+1 < oldest {
+		return nil, false
+	}
+	scopes := make(map[string]bool)
+	for _, entry := range l.Entries {
+		if entry.Seq <= seq {
+			continue
+		}
+		switch entry.Op {
+		case common.OpRename:
+			scopes[entry.Path] = true
+			scopes[entry.NewPath] = true
+		case common.OpRemove:
+			scopes[entry.Path] = true
+		default:
+			if _, ok := scopes[entry.Path]; !ok {
+				scopes[entry.Path] = false
+			}
+		}
+	}
+	return scopes, true
+}
+
+// Flush saves the log if it changed since the last save
+func (l *opLog) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	return l.save()
+}
+
+// Close saves the log along with the root of the directory it leaves behind
+func (l *opLog) Close(root string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Root = root
+	return l.save()
+}
+
+func (l *opLog) save() error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := common.WriteFileAtomic(l.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write operation log: %w", err)
+	}
+	l.dirty = false
+	return nil
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// checkPath validates a path received from a client and tells the client when it is refused
+func (s *Server) checkPath(client *clientConnection, path string) bool {
+	if _, err := common.SafeJoin(s.cfg.SyncDir, path); err != nil {
+		log.Warn().Err(err).Str("client_id", client.id).Msg("Refusing path from client")
+		if err := s.sendMessage(client, common.TypeInvalidPath, common.InvalidPathMessage{Path: path, Reason: err.Error()}); err != nil {
+			log.Error().Err(err).Str("client_id", client.id).Msg("Failed to send path rejection")
+		}
+		return false
+	}
+	return true
+}
+
+// checkLinkTarget validates the target of a symlink received from a client like checkPath
+func (s *Server) checkLinkTarget(client *clientConnection, path, target string) bool {
+	if err := common.ValidateLinkTarget(path, target); err != nil {
+		log.Warn().Err(err).Str("client_id", client.id).Msg("Refusing symlink from client")
+		if err := s.sendMessage(client, common.TypeInvalidPath, common.InvalidPathMessage{Path: path, Reason: err.Error()}); err != nil {
+			log.Error().Err(err).Str("client_id", client.id).Msg("Failed to send path rejection")
+		}
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleInvalidPath(client *clientConnection, wrapper common.MessageWrapper) {
+	var msg common.InvalidPathMessage
+	if err := common.DecodePayload(wrapper, &msg); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal invalid path message")
+		return
+	}
+	log.Warn().Str("path", msg.Path).Str("reason", msg.Reason).Str("client_id", client.id).Msg("Client refused a path sent by the server")
+}
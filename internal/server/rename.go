@@ -0,0 +1,170 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// applyRename moves a file or directory for a client's rename and reports whether it should be broadcast
+func (s *Server) applyRename(envelope fileOperationEnvelope) bool {
+	op := envelope.op
+	source := s.currentState(op.Path)
+	dest := s.currentState(op.NewPath)
+	switch {
+	case source == common.StateRemoved && dest != common.StateRemoved:
+		log.Debug().Str("path", op.Path).Str("new_path", op.NewPath).Msg("Rename already applied, skipping")
+		s.ack(envelope, 0)
+		return false
+	case source == common.StateRemoved:
+		s.rejectRename(envelope, source, "source does not exist on server")
+		return false
+	case (source == common.StateDir) != op.IsDir:
+		s.rejectRename(envelope, source, "source is a different type on server")
+		return false
+	case hasConflict(&op, source):
+		s.rejectRename(envelope, source, "source changed on server")
+		return false
+	case op.IsDir && dest != common.StateRemoved:
+		s.rejectRename(envelope, source, "destination directory already exists on server")
+		return false
+	}
+	s.diskMutex.Lock()
+	defer s.diskMutex.Unlock()
+	oldPath, err := common.SafeJoin(s.cfg.SyncDir, op.Path)
+	if err != nil {
+		log.Error().Err(err).Msg("Refusing to apply rename")
+		s.nackError(envelope, err)
+		return false
+	}
+	newPath, err := common.SafeJoin(s.cfg.SyncDir, op.NewPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Refusing to apply rename")
+		s.nackError(envelope, err)
+		return false
+	}
+	s.expected.ExpectParents(s.cfg.SyncDir, op.NewPath)
+	s.expected.Set(op.Path, common.StateRemoved)
+	s.expected.Set(op.NewPath, source)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		log.Error().Err(err).Str("path", newPath).Msg("Failed to create parent directories")
+		s.nackError(envelope, err)
+		return false
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		log.Error().Err(err).Str("path", op.Path).Str("new_path", op.NewPath).Msg("Failed to rename")
+		s.nackError(envelope, err)
+		return false
+	}
+	s.index.MoveTree(op.Path, op.NewPath)
+	if op.IsDir {
+		common.UnwatchTree(s.watcher, oldPath)
+		common.WatchTree(s.watcher, s.symlinks, newPath, s.watchable)
+	}
+	return true
+}
+
+// rejectRename tells the sender to send the renamed path in full and restores the server's copy
+// of the source on the sender if it still has one
+func (s *Server) rejectRename(envelope fileOperationEnvelope, source, reason string) {
+	op := envelope.op
+	log.Warn().Str("path", op.Path).Str("new_path", op.NewPath).Str("reason", reason).Str("client_id", envelope.senderID).Msg("Rejecting rename")
+	s.nack(envelope.senderID, envelope.opID, op.Path, reason, false)
+	value, ok := s.clients.Load(envelope.senderID)
+	if !ok {
+		return
+	}
+	client := value.(*clientConnection)
+	msg := common.RenameRejectedMessage{Path: op.Path, NewPath: op.NewPath, Reason: reason}
+	if err := s.sendMessage(client, common.TypeRenameRejected, msg); err != nil {
+		log.Error().Err(err).Str("client_id", client.id).Msg("Failed to send rename rejection")
+		return
+	}
+	if source != common.StateRemoved {
+		if err := s.sendTree(client, op.Path); err != nil {
+			log.Error().Err(err).Str("client_id", client.id).Msg("Failed to restore server version on sender")
+		}
+	}
+}
+
+// sendRenameFallback replays a rename as a removal and a full write for clients that can't rename
+func (s *Server) sendRenameFallback(client *clientConnection, op *common.FileOperationMessage) error {
+	remove := common.FileOperationMessage{Op: common.OpRemove, Path: op.Path}
+	if err := s.sendOperation(client, &remove, nil); err != nil {
+		return err
+	}
+	return s.sendTree(client, op.NewPath)
+}
+
+// sendTree sends the server's copy of path, and everything below it for a directory, as write operations
+func (s *Server) sendTree(client *clientConnection, path string) error {
+	root := filepath.Join(s.cfg.SyncDir, path)
+	return s.symlinks.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(s.cfg.SyncDir, fullPath)
+		if err != nil {
+			return err
+		}
+		if s.ignorer.IsIgnored(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		op := common.FileOperationMessage{Op: common.OpWrite, Path: relPath, IsDir: info.IsDir()}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if op.LinkTarget, err = os.Readlink(fullPath); err != nil {
+				return err
+			}
+			return s.sendOperation(client, &op, nil)
+		}
+		op.FileMeta = common.MetaOf(info)
+		if !info.IsDir() {
+			if op.Hash, err = s.index.State(fullPath, info); err != nil {
+				return err
+			}
+			op.ContentPath = fullPath
+		}
+		return s.sendOperation(client, &op, nil)
+	})
+}
+
+// expandDir returns the files below path if it is a directory, or path itself otherwise
+func (s *Server) expandDir(path string) []string {
+	root := filepath.Join(s.cfg.SyncDir, path)
+	if info, err := s.symlinks.Stat(root); err != nil || !info.IsDir() {
+		return []string{path}
+	}
+	var files []string
+	s.symlinks.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		relPath, _ := filepath.Rel(s.cfg.SyncDir, fullPath)
+		if s.ignorer.IsIgnored(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			files = append(files, relPath)
+		}
+		return nil
+	})
+	return files
+}
+
+// watchable decides which directories the server watcher follows and remembers the permissions of every entry
+func (s *Server) watchable(path string, info os.FileInfo) bool {
+	relPath, err := filepath.Rel(s.cfg.SyncDir, path)
+	if err != nil || (relPath != "." && s.ignorer.IsIgnored(relPath)) {
+		return false
+	}
+	s.expected.SetMode(relPath, common.MetaOf(info).Mode)
+	return true
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// resumeClient catches a reconnecting client up on the paths changed since its resume point and
+// adds it to the broadcast, or returns false if the log no longer reaches back that far. Holding
+// opMutex keeps operations from slipping in between the catch-up and the first broadcast.
+func (s *Server) resumeClient(client *clientConnection) (bool, error) {
+	s.opMutex.Lock()
+	defer s.opMutex.Unlock()
+	scopes, ok := s.oplog.Since(client.resume.Epoch, client.resume.Seq)
+	if !ok {
+		log.Info().Str("client_id", client.id).Uint64("seq", client.resume.Seq).Msg("Operation log does not reach the client's resume point, sending manifest")
+		return false, nil
+	}
+	// Replies to requests cut off by the disconnect are sent again as part of the catch-up
+	for _, path := range client.resume.Pending {
+		if s.checkPath(client, path) {
+			scopes[path] = true
+		}
+	}
+	_, seq := s.oplog.Position()
+	manifest := s.scopedManifest(scopes)
+	s.filterManifest(client, &manifest)
+	log.Info().Str("client_id", client.id).Uint64("from", client.resume.Seq).Uint64("to", seq).Int("paths", len(scopes)).Msg("Resuming client from operation log")
+	if err := s.sendMessage(client, common.TypeResume, common.ResumeMessage{Seq: seq, Scopes: scopes, Manifest: manifest}); err != nil {
+		return false, err
+	}
+	s.clients.Store(client.id, client)
+	return true, nil
+}
+
+// scopedManifest builds the manifest of the given paths, including everything below those
+// marked as whole subtrees
+func (s *Server) scopedManifest(scopes map[string]bool) common.ManifestMessage {
+	manifest := common.ManifestMessage{Files: make(map[string]string), Meta: make(map[string]common.FileMeta)}
+	dirs := make(map[string]bool)
+	add := func(fullPath string, info os.FileInfo) error {
+		relPath, err := filepath.Rel(s.cfg.SyncDir, fullPath)
+		if err != nil || relPath == "." {
+			return nil
+		}
+		if s.ignorer.IsIgnored(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			dirs[relPath] = true
+			return nil
+		}
+		state, err := s.index.State(fullPath, info)
+		if err != nil {
+			log.Error().Err(err).Str("path", relPath).Msg("Failed to compute hash for file")
+			return nil
+		}
+		manifest.Files[relPath] = state
+		if info.Mode()&os.ModeSymlink == 0 {
+			manifest.Meta[relPath] = common.MetaOf(info)
+		}
+		return nil
+	}
+	for path, subtree := range scopes {
+		fullPath := filepath.Join(s.cfg.SyncDir, path)
+		if !subtree {
+			if info, err := s.symlinks.Stat(fullPath); err == nil {
+				add(fullPath, info)
+			}
+			continue
+		}
+		s.symlinks.Walk(fullPath, func(walkPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			return add(walkPath, info)
+		})
+	}
+	for dir := range dirs {
+		manifest.Dirs = append(manifest.Dirs, dir)
+	}
+	slices.Sort(manifest.Dirs)
+	return manifest
+}
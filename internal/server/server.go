@@ -1,13 +1,14 @@
 package server
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
-	"path/filepath"
 	"sync"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
@@ -18,44 +19,129 @@ type Config struct {
 	Port        int
 	SyncDir     string
 	IgnorePaths string
+	TLSCert     string
+	TLSKey      string
+	// TLSClientCA, when set, makes the server only accept clients with a certificate signed by it
+	TLSClientCA string
+	// TokensFile holds the name:token pairs clients authenticate with; empty disables authentication
+	TokensFile string
+	// Symlinks is the symlink mode: preserve, follow or skip
+	Symlinks string
 }
 
 type clientConnection struct {
-	id         string
+	id string
+	// name is the authenticated identity, shared by all connections using the same token
+	name       string
 	conn       *websocket.Conn
+	codec      common.Codec
+	protocol   int
+	caps       common.Capabilities
 	writeMutex sync.Mutex
+	// transfers in progress from this client, only touched by its read loop
+	transfers map[string]*common.IncomingTransfer
+	// tree is the manifest tree sent on connect, which the client descends during initial sync
+	tree *common.ManifestTree
+	// resume is where the client asked to catch up from instead of receiving a manifest
+	resume *common.ResumePoint
 }
 
 type fileOperationEnvelope struct {
-	senderID string
-	op       common.FileOperationMessage
+	senderID   string
+	senderName string
+	op         common.FileOperationMessage
+	// opID is the ID the sender gave the operation, answered with an ack or nack
+	opID string
 }
 
 type Server struct {
 	cfg       Config
+	tls       *tls.Config
+	tokens    tokenStore
 	clients   sync.Map // A concurrent map to store clients: map[string]*clientConnection
 	ignorer   *common.PathIgnorer
+	symlinks  *common.SymlinkPolicy
+	index     *common.Index
+	oplog     *opLog
 	opChan    chan fileOperationEnvelope
 	diskMutex sync.Mutex
+	watcher   *fsnotify.Watcher
+	// expected tracks what the server itself last wrote so its watcher ignores those events
+	expected *common.ExpectedState
+	// opMutex is held while an operation is applied and broadcast, so the operation log, the
+	// disk and what connected clients were sent stay in step
+	opMutex sync.Mutex
 }
 
 func New(cfg Config) (*Server, error) {
 	if err := os.MkdirAll(cfg.SyncDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create sync directory: %w", err)
 	}
+	if err := common.ResetTempDir(cfg.SyncDir); err != nil {
+		return nil, fmt.Errorf("failed to prepare temp directory: %w", err)
+	}
+	tlsConfig, err := common.ServerTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	symlinks, err := common.NewSymlinkPolicy(cfg.SyncDir, cfg.Symlinks)
+	if err != nil {
+		return nil, err
+	}
+	index, err := common.LoadIndex(cfg.SyncDir)
+	if err != nil {
+		return nil, err
+	}
+	ignorer := common.NewPathIgnorer(cfg.SyncDir, cfg.IgnorePaths)
+	manifest, err := common.BuildFileManifest(cfg.SyncDir, ignorer, symlinks, index)
+	if err != nil {
+		return nil, fmt.Errorf("could not build file manifest: %w", err)
+	}
+	oplog, err := loadOpLog(cfg.SyncDir, common.NewManifestTree(&manifest).Root())
+	if err != nil {
+		return nil, err
+	}
+	var tokens tokenStore
+	if cfg.TokensFile != "" {
+		if tokens, err = loadTokens(cfg.TokensFile); err != nil {
+			return nil, err
+		}
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
 	return &Server{
-		cfg:     cfg,
-		ignorer: common.NewPathIgnorer(cfg.IgnorePaths),
+		cfg:      cfg,
+		tls:      tlsConfig,
+		tokens:   tokens,
+		ignorer:  ignorer,
+		symlinks: symlinks,
+		index:    index,
+		oplog:    oplog,
 		// Buffered channel to act as the operation ingest queue
-		opChan: make(chan fileOperationEnvelope, 100),
+		opChan:   make(chan fileOperationEnvelope, 100),
+		watcher:  watcher,
+		expected: common.NewExpectedState(),
 	}, nil
 }
 
 func (s *Server) Run() error {
 	// Central goroutine to process all incoming operations serially
 	go s.processOperationQueue()
+	go s.watchFilesystem()
+	go s.flushState()
+	defer s.watcher.Close()
+	if s.tokens == nil {
+		log.Warn().Msg("No tokens file configured, any client that can reach the server may connect")
+	}
 	http.HandleFunc("/ws", s.handleConnections)
 	addr := fmt.Sprintf(":%d", s.cfg.Port)
+	if s.tls != nil {
+		log.Info().Str("address", addr).Bool("client_certs", s.tls.ClientCAs != nil).Msg("WebSocket server starting to listen with TLS")
+		httpServer := &http.Server{Addr: addr, TLSConfig: s.tls}
+		return httpServer.ListenAndServeTLS("", "")
+	}
 	log.Info().Str("address", addr).Msg("WebSocket server starting to listen")
 	return http.ListenAndServe(addr, nil)
 }
@@ -63,15 +149,60 @@ func (s *Server) Run() error {
 func (s *Server) processOperationQueue() {
 	log.Info().Msg("Starting file operation queue processor")
 	for envelope := range s.opChan {
-		log.Info().Str("op", string(envelope.op.Op)).Str("path", envelope.op.Path).Str("client_id", envelope.senderID).Msg("Processing operation from queue")
-		s.applyChangeLocally(&envelope.op)
-		s.broadcastOperation(envelope.senderID, &envelope.op)
+		s.opMutex.Lock()
+		s.processOperation(envelope)
+		s.opMutex.Unlock()
 	}
 }
 
+func (s *Server) processOperation(envelope fileOperationEnvelope) {
+	log.Info().Str("op", string(envelope.op.Op)).Str("path", envelope.op.Path).Str("client_id", envelope.senderID).Msg("Processing operation from queue")
+	// Operations from the server's own watcher are already on disk
+	if envelope.op.Op == common.OpRename {
+		if !s.applyRename(envelope) {
+			return
+		}
+	} else if envelope.senderID != serverSenderID {
+		current := s.currentState(envelope.op.Path)
+		if envelope.op.Delta != nil && !s.expandDelta(&envelope, current) {
+			return
+		}
+		if isNoop(&envelope.op, current) {
+			log.Debug().Str("path", envelope.op.Path).Msg("Operation matches current state, skipping")
+			s.discardTemp(&envelope.op)
+			s.ack(envelope, 0)
+			return
+		}
+		if hasConflict(&envelope.op, current) {
+			s.resolveConflict(envelope, current)
+			return
+		}
+		if err := s.applyChangeLocally(&envelope.op); err != nil {
+			s.nackError(envelope, err)
+			return
+		}
+	}
+	s.broadcastOperation(envelope.senderID, &envelope.op)
+	s.ack(envelope, envelope.op.Seq)
+}
+
 func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	id := uuid.NewString()
+	name := id
+	if s.tokens != nil {
+		var ok bool
+		if name, ok = s.tokens.identify(r); !ok {
+			log.Warn().Str("addr", r.RemoteAddr).Msg("Rejecting connection with missing or invalid token")
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		// Several machines may share a token, so connections still get a unique ID
+		id = name + "-" + id[:8]
+	}
+	// The default origin check refuses cross-site browser connections; fs-entangle clients send no Origin
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		Subprotocols:      common.Subprotocols,
+		EnableCompression: true,
 	}
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -80,139 +211,264 @@ func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
 	}
 	defer ws.Close()
 	client := &clientConnection{
-		id:   uuid.NewString(),
-		conn: ws,
+		id:        id,
+		name:      name,
+		conn:      ws,
+		codec:     common.CodecFor(ws.Subprotocol()),
+		transfers: make(map[string]*common.IncomingTransfer),
 	}
-	s.clients.Store(client.id, client)
-	log.Info().Str("client_id", client.id).Str("addr", ws.RemoteAddr().String()).Msg("Client connected")
+	if err := s.handshake(client); err != nil {
+		log.Error().Err(err).Str("client_id", client.id).Msg("Handshake failed")
+		return
+	}
+	logEvent := log.Info().Str("client_id", client.id).Str("addr", ws.RemoteAddr().String()).Str("codec", client.codec.Name())
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		logEvent = logEvent.Str("cert", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	logEvent.Msg("Client connected")
 	defer func() {
 		s.clients.Delete(client.id)
+		s.abortTransfers(client)
 		log.Info().Str("client_id", client.id).Msg("Client disconnected")
 	}()
-	if err := s.sendInitialManifest(client); err != nil {
-		log.Error().Err(err).Str("client_id", client.id).Msg("Failed to send initial manifest")
-		return
+	resumed := false
+	if client.resume != nil {
+		if resumed, err = s.resumeClient(client); err != nil {
+			log.Error().Err(err).Str("client_id", client.id).Msg("Failed to resume client")
+			return
+		}
+	}
+	if !resumed {
+		s.clients.Store(client.id, client)
+		if err := s.sendInitialManifest(client); err != nil {
+			log.Error().Err(err).Str("client_id", client.id).Msg("Failed to send initial manifest")
+			return
+		}
 	}
 	s.handleClientMessages(client)
 }
 
 func (s *Server) sendInitialManifest(client *clientConnection) error {
 	log.Info().Str("client_id", client.id).Msg("Building and sending initial manifest")
-	manifest, err := common.BuildFileManifest(s.cfg.SyncDir, s.ignorer)
+	// Taken first, as operations broadcast while building may or may not be included
+	_, seq := s.oplog.Position()
+	manifest, err := common.BuildFileManifest(s.cfg.SyncDir, s.ignorer, s.symlinks, s.index)
 	if err != nil {
 		return fmt.Errorf("could not build file manifest: %w", err)
 	}
-	payload, _ := json.Marshal(common.ManifestMessage{Files: manifest})
-	msg := common.MessageWrapper{
-		Type:    common.TypeManifest,
-		Payload: payload,
+	s.filterManifest(client, &manifest)
+	manifest.Seq = seq
+	if client.caps.Has(common.CapTree) {
+		client.tree = common.NewManifestTree(&manifest)
+		return s.sendMessage(client, common.TypeManifestTree, common.ManifestTreeMessage{Root: client.tree.Root(), Seq: seq})
+	}
+	return s.sendMessage(client, common.TypeManifest, manifest)
+}
+
+// filterManifest drops what the client has not negotiated the capabilities for
+func (s *Server) filterManifest(client *clientConnection, manifest *common.ManifestMessage) {
+	if !client.caps.Has(common.CapSymlinks) {
+		maps.DeleteFunc(manifest.Files, func(path, state string) bool {
+			_, isLink := common.LinkTarget(state)
+			return isLink
+		})
+	}
+	if !client.caps.Has(common.CapMetadata) {
+		manifest.Meta = nil
 	}
-	return s.sendMessage(client, msg)
 }
 
 func (s *Server) handleClientMessages(client *clientConnection) {
 	for {
-		var wrapper common.MessageWrapper
-		if err := client.conn.ReadJSON(&wrapper); err != nil {
+		frameType, data, err := client.conn.ReadMessage()
+		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Error().Err(err).Str("client_id", client.id).Msg("Client read error")
 			}
 			break
 		}
+		wrapper, err := client.codec.Decode(frameType, data)
+		if err != nil {
+			log.Error().Err(err).Str("client_id", client.id).Msg("Failed to decode message from client")
+			continue
+		}
 		switch wrapper.Type {
+		case common.TypeTreeRequest:
+			s.handleTreeRequest(client, wrapper)
 		case common.TypeFileRequest:
-			s.handleFileRequest(client, wrapper.Payload)
+			s.handleFileRequest(client, wrapper)
 		case common.TypeFileOperation:
-			s.handleFileOperation(client, wrapper.Payload)
+			s.handleFileOperation(client, wrapper)
+		case common.TypeSignatureRequest:
+			s.handleSignatureRequest(client, wrapper)
+		case common.TypeTransferBegin:
+			s.handleTransferBegin(client, wrapper)
+		case common.TypeTransferChunk:
+			s.handleTransferChunk(client, wrapper)
+		case common.TypeTransferCommit:
+			s.handleTransferCommit(client, wrapper)
+		case common.TypeTransferAbort:
+			s.handleTransferAbort(client, wrapper)
+		case common.TypeInvalidPath:
+			s.handleInvalidPath(client, wrapper)
 		default:
 			log.Warn().Str("type", string(wrapper.Type)).Msg("Received unknown message type from client")
 		}
 	}
 }
 
-func (s *Server) handleFileRequest(client *clientConnection, payload []byte) {
+func (s *Server) handleFileRequest(client *clientConnection, wrapper common.MessageWrapper) {
 	var req common.FileRequestMessage
-	if err := json.Unmarshal(payload, &req); err != nil {
+	if err := common.DecodePayload(wrapper, &req); err != nil {
 		log.Error().Err(err).Msg("Failed to unmarshal file request")
 		return
 	}
 	log.Info().Int("count", len(req.Paths)).Str("client_id", client.id).Msg("Handling file request")
+	var paths []string
 	for _, path := range req.Paths {
-		if s.ignorer.IsIgnored(path) {
-			continue
-		}
-		fullPath := filepath.Join(s.cfg.SyncDir, path)
-		content, err := os.ReadFile(fullPath)
-		if err != nil {
-			log.Error().Err(err).Str("path", path).Msg("Failed to read file for client request")
-			continue
+		if !s.ignorer.IsIgnored(path) && s.checkPath(client, path) {
+			paths = append(paths, s.expandDir(path)...)
 		}
-		contentPayload, _ := json.Marshal(common.FileContentMessage{Path: path, Content: content})
-		msg := common.MessageWrapper{
-			Type:    common.TypeFileContent,
-			Payload: contentPayload,
-		}
-		if err := s.sendMessage(client, msg); err != nil {
+	}
+	for _, path := range paths {
+		if err := s.sendFileContent(client, path, req.Signatures[path]); err != nil {
+			if os.IsNotExist(err) {
+				log.Error().Err(err).Str("path", path).Msg("Failed to read file for client request")
+				continue
+			}
 			log.Error().Err(err).Str("client_id", client.id).Msg("Failed to send file content")
 			break
 		}
 	}
 }
 
-func (s *Server) handleFileOperation(sender *clientConnection, payload []byte) {
+func (s *Server) handleFileOperation(sender *clientConnection, wrapper common.MessageWrapper) {
 	var op common.FileOperationMessage
-	if err := json.Unmarshal(payload, &op); err != nil {
+	if err := common.DecodePayload(wrapper, &op); err != nil {
 		log.Error().Err(err).Msg("Failed to unmarshal file operation")
 		return
 	}
+	// The ID is only meaningful to the sender, so it is not broadcast
+	opID := op.ID
+	op.ID = ""
 	if s.ignorer.IsIgnored(op.Path) {
 		log.Debug().Str("path", op.Path).Msg("Ignoring file operation based on server rules")
+		s.nack(sender.id, opID, op.Path, "path is ignored by the server", false)
+		return
+	}
+	if !s.checkPath(sender, op.Path) {
+		s.nack(sender.id, opID, op.Path, "invalid path", false)
 		return
 	}
+	if op.LinkTarget != "" && (!sender.caps.Has(common.CapSymlinks) || s.symlinks.Mode != common.SymlinksPreserve) {
+		s.nack(sender.id, opID, op.Path, "symlinks are not synced as links", false)
+		return
+	}
+	if op.LinkTarget != "" && !s.checkLinkTarget(sender, op.Path, op.LinkTarget) {
+		s.nack(sender.id, opID, op.Path, "invalid symlink target", false)
+		return
+	}
+	if op.Op == common.OpRename {
+		if !s.checkPath(sender, op.NewPath) {
+			s.nack(sender.id, opID, op.Path, "invalid path", false)
+			return
+		}
+		if s.ignorer.IsIgnored(op.NewPath) {
+			// Renaming into an ignored path looks like a removal to everyone else
+			op.Op = common.OpRemove
+			op.NewPath = ""
+		}
+	}
 	log.Debug().Str("path", op.Path).Str("client_id", sender.id).Msg("Received and queuing file operation")
 	s.opChan <- fileOperationEnvelope{
-		senderID: sender.id,
-		op:       op,
+		senderID:   sender.id,
+		senderName: sender.name,
+		opID:       opID,
+		op:         op,
 	}
 }
 
-func (s *Server) applyChangeLocally(op *common.FileOperationMessage) {
+// applyChangeLocally writes op to disk, returning why it could not be applied
+func (s *Server) applyChangeLocally(op *common.FileOperationMessage) error {
 	s.diskMutex.Lock()
 	defer s.diskMutex.Unlock()
-	fullPath := filepath.Join(s.cfg.SyncDir, op.Path)
+	// Checked again as symlinks on disk may have changed while the operation was queued
+	fullPath, err := common.SafeJoin(s.cfg.SyncDir, op.Path)
+	if err != nil {
+		log.Error().Err(err).Msg("Refusing to apply operation")
+		s.discardTemp(op)
+		return err
+	}
 	switch op.Op {
 	case common.OpWrite:
 		if op.IsDir {
+			s.expected.ExpectParents(s.cfg.SyncDir, op.Path)
+			s.expected.Set(op.Path, common.StateDir)
 			if err := os.MkdirAll(fullPath, 0755); err != nil {
 				log.Error().Err(err).Str("path", fullPath).Msg("Failed to create directory")
+				return err
 			}
-			return
+			if op.Mode != 0 {
+				s.expected.SetMode(op.Path, op.Mode)
+				s.applyMeta(op, fullPath)
+			}
+			return nil
 		}
-		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-			log.Error().Err(err).Str("path", fullPath).Msg("Failed to create parent directories")
-			return
+		s.expected.ExpectParents(s.cfg.SyncDir, op.Path)
+		s.expected.Set(op.Path, op.ContentHash())
+		if op.LinkTarget != "" {
+			if err := common.CreateSymlink(fullPath, op.LinkTarget); err != nil {
+				log.Error().Err(err).Str("path", fullPath).Msg("Failed to create symlink")
+				return err
+			}
+			return nil
 		}
-		if err := os.WriteFile(fullPath, op.Content, 0644); err != nil {
+		perm := op.Perm(fullPath)
+		s.expected.SetMode(op.Path, uint32(perm))
+		if op.ContentPath != "" {
+			if err := common.PlaceFile(op.ContentPath, fullPath, perm); err != nil {
+				log.Error().Err(err).Str("path", fullPath).Msg("Failed to move received file into place")
+				s.discardTemp(op)
+				return err
+			}
+			op.ContentPath = fullPath // broadcasts stream from the final location
+		} else if err := common.WriteFileAtomic(fullPath, op.Content, perm); err != nil {
 			log.Error().Err(err).Str("path", fullPath).Msg("Failed to write file")
+			return err
+		}
+		s.applyMeta(op, fullPath)
+	case common.OpMeta:
+		// Changing times is reported as a write, which has to be recognized as our own
+		if state, err := s.symlinks.State(fullPath); err == nil {
+			s.expected.Set(op.Path, state)
 		}
+		s.expected.SetMode(op.Path, op.Mode)
+		s.applyMeta(op, fullPath)
 	case common.OpRemove:
+		s.expected.Set(op.Path, common.StateRemoved)
 		if err := os.RemoveAll(fullPath); err != nil {
 			log.Error().Err(err).Str("path", fullPath).Msg("Failed to remove file/directory")
+			return err
 		}
 	}
+	return nil
 }
 
-func (s *Server) broadcastOperation(senderID string, op *common.FileOperationMessage) {
-	payload, _ := json.Marshal(op)
-	msg := common.MessageWrapper{
-		Type:    common.TypeFileOperation,
-		Payload: payload,
+func (s *Server) applyMeta(op *common.FileOperationMessage, fullPath string) {
+	if err := op.FileMeta.Apply(fullPath); err != nil {
+		log.Error().Err(err).Str("path", fullPath).Msg("Failed to apply file metadata")
 	}
+}
+
+func (s *Server) broadcastOperation(senderID string, op *common.FileOperationMessage) {
+	s.oplog.Append(op)
+	// Frames are encoded once per codec and form rather than once per client
+	frames := make(map[string]encodedFrame)
 	s.clients.Range(func(key, value interface{}) bool {
 		id := key.(string)
 		client := value.(*clientConnection)
 		if id != senderID {
-			if err := s.sendMessage(client, msg); err != nil {
+			if err := s.sendOperation(client, op, frames); err != nil {
 				log.Error().Err(err).Str("client_id", id).Msg("Failed to broadcast operation")
 			}
 		}
@@ -220,8 +476,21 @@ func (s *Server) broadcastOperation(senderID string, op *common.FileOperationMes
 	})
 }
 
-func (s *Server) sendMessage(client *clientConnection, message common.MessageWrapper) error {
+type encodedFrame struct {
+	frameType int
+	data      []byte
+}
+
+func (s *Server) sendMessage(client *clientConnection, msgType common.MessageType, payload any) error {
+	frameType, data, err := client.codec.Encode(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return s.sendFrame(client, encodedFrame{frameType: frameType, data: data})
+}
+
+func (s *Server) sendFrame(client *clientConnection, frame encodedFrame) error {
 	client.writeMutex.Lock()
 	defer client.writeMutex.Unlock()
-	return client.conn.WriteJSON(message)
+	return client.conn.WriteMessage(frame.frameType, frame.data)
 }
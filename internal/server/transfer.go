@@ -0,0 +1,182 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+func (s *Server) handleTransferBegin(client *clientConnection, wrapper common.MessageWrapper) {
+	var begin common.TransferBeginMessage
+	if err := common.DecodePayload(wrapper, &begin); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal transfer begin")
+		return
+	}
+	if begin.Op == nil {
+		log.Warn().Str("path", begin.Path).Str("client_id", client.id).Msg("Rejecting transfer without a write operation")
+		return
+	}
+	// Only file content is streamed, so anything else riding on the operation skips the checks
+	// the same fields get when sent as a plain operation
+	if begin.Op.Op != common.OpWrite || begin.Op.IsDir || begin.Op.LinkTarget != "" || begin.Op.NewPath != "" {
+		s.nack(client.id, begin.Op.ID, begin.Path, "transfer is not a file write", false)
+		return
+	}
+	if !s.checkPath(client, begin.Path) {
+		s.nack(client.id, begin.Op.ID, begin.Path, "invalid path", false)
+		return
+	}
+	transfer, err := common.NewIncomingTransfer(s.cfg.SyncDir, begin)
+	if err != nil {
+		log.Error().Err(err).Str("path", begin.Path).Msg("Failed to start transfer")
+		s.nack(client.id, begin.Op.ID, begin.Path, err.Error(), true)
+		return
+	}
+	log.Info().Str("path", begin.Path).Int64("size", begin.Size).Str("client_id", client.id).Msg("Receiving file transfer")
+	client.transfers[begin.ID] = transfer
+}
+
+func (s *Server) handleTransferChunk(client *clientConnection, wrapper common.MessageWrapper) {
+	var chunk common.TransferChunkMessage
+	if err := common.DecodePayload(wrapper, &chunk); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal transfer chunk")
+		return
+	}
+	transfer, ok := client.transfers[chunk.ID]
+	if !ok {
+		return
+	}
+	if err := transfer.Write(chunk); err != nil {
+		log.Error().Err(err).Str("path", transfer.Begin.Path).Msg("Failed to write transfer chunk")
+		transfer.Abort()
+		delete(client.transfers, chunk.ID)
+		s.nack(client.id, transfer.Begin.Op.ID, transfer.Begin.Path, err.Error(), true)
+	}
+}
+
+func (s *Server) handleTransferCommit(client *clientConnection, wrapper common.MessageWrapper) {
+	var commit common.TransferCommitMessage
+	if err := common.DecodePayload(wrapper, &commit); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal transfer commit")
+		return
+	}
+	transfer, ok := client.transfers[commit.ID]
+	if !ok {
+		return
+	}
+	delete(client.transfers, commit.ID)
+	tmpPath, err := transfer.Commit(commit.Hash)
+	if err != nil {
+		log.Error().Err(err).Str("path", transfer.Begin.Path).Msg("Failed to commit transfer")
+		s.nack(client.id, transfer.Begin.Op.ID, transfer.Begin.Path, err.Error(), true)
+		return
+	}
+	op := *transfer.Begin.Op
+	opID := op.ID
+	op.ID = ""
+	op.Path = transfer.Begin.Path
+	op.Content = nil
+	op.ContentPath = tmpPath
+	op.Hash = commit.Hash
+	if s.ignorer.IsIgnored(op.Path) {
+		os.Remove(tmpPath)
+		s.nack(client.id, opID, op.Path, "path is ignored by the server", false)
+		return
+	}
+	log.Debug().Str("path", op.Path).Str("client_id", client.id).Msg("Received and queuing streamed file operation")
+	s.opChan <- fileOperationEnvelope{
+		senderID:   client.id,
+		senderName: client.name,
+		opID:       opID,
+		op:         op,
+	}
+}
+
+func (s *Server) handleTransferAbort(client *clientConnection, wrapper common.MessageWrapper) {
+	var abort common.TransferAbortMessage
+	if err := common.DecodePayload(wrapper, &abort); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal transfer abort")
+		return
+	}
+	if transfer, ok := client.transfers[abort.ID]; ok {
+		log.Warn().Str("path", transfer.Begin.Path).Str("reason", abort.Reason).Msg("Client aborted transfer")
+		transfer.Abort()
+		delete(client.transfers, abort.ID)
+	}
+}
+
+func (s *Server) abortTransfers(client *clientConnection) {
+	for id, transfer := range client.transfers {
+		transfer.Abort()
+		delete(client.transfers, id)
+	}
+}
+
+// streamOperation sends a write whose content lives in op.ContentPath as a chunked transfer
+func (s *Server) streamOperation(client *clientConnection, op *common.FileOperationMessage) error {
+	wire := *op
+	wire.Content = nil
+	begin := common.TransferBeginMessage{Path: op.Path, Op: &wire}
+	_, err := common.StreamFile(op.ContentPath, begin, func(msgType common.MessageType, payload any) error {
+		return s.sendMessage(client, msgType, payload)
+	})
+	return err
+}
+
+// sendOperation sends op to a single client in the most efficient form its capabilities allow.
+// frames caches encodings across calls and may be nil.
+func (s *Server) sendOperation(client *clientConnection, op *common.FileOperationMessage, frames map[string]encodedFrame) error {
+	if op.Op == common.OpRename && !client.caps.Has(common.CapRename) {
+		return s.sendRenameFallback(client, op)
+	}
+	if op.Op == common.OpMeta && !client.caps.Has(common.CapMetadata) {
+		return nil
+	}
+	if op.LinkTarget != "" && !client.caps.Has(common.CapSymlinks) {
+		return nil
+	}
+	wire := *op
+	form := "full"
+	switch {
+	case wire.Delta != nil && client.caps.Has(common.CapDelta):
+		// Clients in sync hold the delta base
+		form = "delta"
+		wire.Content = nil
+		wire.ContentPath = ""
+	case wire.ContentPath != "" && client.caps.Has(common.CapChunked):
+		wire.Delta = nil
+		return s.streamOperation(client, &wire)
+	case wire.ContentPath != "":
+		content, err := os.ReadFile(wire.ContentPath)
+		if err != nil {
+			return err
+		}
+		wire.Content = content
+		wire.ContentPath = ""
+		wire.Delta = nil
+	default:
+		wire.Delta = nil
+	}
+	key := client.codec.Name() + "/" + form
+	frame, ok := frames[key]
+	if !ok {
+		var err error
+		frame.frameType, frame.data, err = client.codec.Encode(common.TypeFileOperation, wire)
+		if err != nil {
+			return err
+		}
+		if frames != nil {
+			frames[key] = frame
+		}
+	}
+	return s.sendFrame(client, frame)
+}
+
+// discardTemp removes the temp file of an operation that was not applied
+func (s *Server) discardTemp(op *common.FileOperationMessage) {
+	if op.ContentPath != "" && filepath.Dir(op.ContentPath) == common.TempDir(s.cfg.SyncDir) {
+		os.Remove(op.ContentPath)
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// handleTreeRequest sends the listings of the directories a client found to differ from its own
+func (s *Server) handleTreeRequest(client *clientConnection, wrapper common.MessageWrapper) {
+	var req common.TreeRequestMessage
+	if err := common.DecodePayload(wrapper, &req); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal tree request")
+		return
+	}
+	if client.tree == nil {
+		log.Warn().Str("client_id", client.id).Msg("Received tree request without a manifest tree")
+		return
+	}
+	log.Debug().Int("count", len(req.Dirs)).Str("client_id", client.id).Msg("Handling tree request")
+	msg := common.ManifestTreeMessage{Root: client.tree.Root(), Listings: make(map[string][]common.TreeEntry, len(req.Dirs))}
+	for _, dir := range req.Dirs {
+		msg.Listings[dir] = client.tree.Listing(dir)
+	}
+	if err := s.sendMessage(client, common.TypeManifestTree, msg); err != nil {
+		log.Error().Err(err).Str("client_id", client.id).Msg("Failed to send tree listings")
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/tanq16/fs-entangle/internal/common"
+)
+
+// serverSenderID marks operations that originate from edits made directly in the server's directory
+const serverSenderID = "server"
+
+const indexFlushInterval = 10 * time.Second
+
+func (s *Server) watchFilesystem() {
+	common.WatchTree(s.watcher, s.symlinks, s.cfg.SyncDir, s.watchable)
+	log.Info().Str("directory", s.cfg.SyncDir).Msg("Watching server directory for local changes")
+	events := common.NewDebouncer()
+	ticker := time.NewTicker(common.SettleDelay / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+				// Directories are handled right away so they are watched before files appear in them
+				s.handleFsEvent(event)
+				continue
+			}
+			events.Add(event, time.Now())
+		case <-ticker.C:
+			for _, event := range events.Settled(time.Now()) {
+				s.handleFsEvent(event)
+			}
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msg("Watcher error")
+		}
+	}
+}
+
+func (s *Server) handleFsEvent(event fsnotify.Event) {
+	relPath, err := filepath.Rel(s.cfg.SyncDir, event.Name)
+	if err != nil || s.ignorer.IsIgnored(relPath) {
+		return
+	}
+	if filepath.Base(relPath) == common.IgnoreFileName {
+		s.ignorer.Reload(relPath)
+	}
+	// Wait for any in-flight write from the operation queue so the state read below is complete
+	s.diskMutex.Lock()
+	op, state, ok := s.readLocalState(event, relPath)
+	s.diskMutex.Unlock()
+	if !ok {
+		return
+	}
+	if op.Op == common.OpMeta {
+		if s.expected.ModeMatches(relPath, op.Mode) {
+			return
+		}
+		s.expected.SetMode(relPath, op.Mode)
+		log.Info().Str("op", string(op.Op)).Str("path", relPath).Msg("Detected permission change in server directory")
+		s.opChan <- fileOperationEnvelope{senderID: serverSenderID, senderName: serverSenderID, op: op}
+		return
+	}
+	if s.expected.Matches(relPath, state) || (state == common.StateRemoved && s.expected.ParentRemoved(relPath)) {
+		log.Debug().Str("path", relPath).Msg("Suppressing watcher event for own write")
+		return
+	}
+	s.expected.Set(relPath, state)
+	s.expected.SetMode(relPath, op.Mode)
+	log.Info().Str("op", string(op.Op)).Str("path", relPath).Msg("Detected local change in server directory")
+	s.opChan <- fileOperationEnvelope{
+		senderID:   serverSenderID,
+		senderName: serverSenderID,
+		op:         op,
+	}
+	if op.IsDir {
+		s.queueNewTree(relPath)
+	}
+}
+
+// queueNewTree broadcasts what is already inside a directory that appeared in the server directory
+func (s *Server) queueNewTree(path string) {
+	common.WalkNewTree(s.cfg.SyncDir, path, s.symlinks, s.ignorer, s.index, s.expected, func(relPath, fullPath string, info os.FileInfo) {
+		op := common.FileOperationMessage{Op: common.OpWrite, Path: relPath, IsDir: true, FileMeta: common.MetaOf(info)}
+		if !info.IsDir() {
+			var ok bool
+			s.diskMutex.Lock()
+			op, _, ok = s.readLocalState(fsnotify.Event{Name: fullPath, Op: fsnotify.Create}, relPath)
+			s.diskMutex.Unlock()
+			if !ok {
+				return
+			}
+		}
+		log.Info().Str("op", string(op.Op)).Str("path", relPath).Msg("Found entry inside new directory in server directory")
+		s.opChan <- fileOperationEnvelope{
+			senderID:   serverSenderID,
+			senderName: serverSenderID,
+			op:         op,
+		}
+	})
+}
+
+func (s *Server) readLocalState(event fsnotify.Event, relPath string) (common.FileOperationMessage, string, bool) {
+	op := common.FileOperationMessage{Path: relPath}
+	info, err := s.symlinks.Stat(event.Name)
+	if errors.Is(err, common.ErrSymlinkSkipped) {
+		return op, "", false
+	}
+	if err != nil {
+		if !os.IsNotExist(err) || event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+			return op, "", false
+		}
+		common.UnwatchTree(s.watcher, event.Name)
+		s.index.DeleteTree(relPath)
+		op.Op = common.OpRemove
+		return op, common.StateRemoved, true
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if event.Op&fsnotify.Create == 0 {
+			return op, "", false
+		}
+		if op.LinkTarget, err = os.Readlink(event.Name); err != nil {
+			return op, "", false
+		}
+		op.Op = common.OpWrite
+		return op, op.ContentHash(), true
+	}
+	op.FileMeta = common.MetaOf(info)
+	if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+		if event.Op&fsnotify.Chmod == 0 {
+			return op, "", false
+		}
+		op.Op = common.OpMeta
+		op.IsDir = info.IsDir()
+		return op, "", true
+	}
+	op.Op = common.OpWrite
+	if info.IsDir() {
+		if event.Op&fsnotify.Create == 0 {
+			return op, "", false
+		}
+		// Always watch new directories, even ones created by the sync engine itself
+		common.WatchTree(s.watcher, s.symlinks, event.Name, s.watchable)
+		op.IsDir = true
+		return op, common.StateDir, true
+	}
+	if info.Size() >= common.StreamThreshold {
+		// Large files are streamed to clients straight from disk
+		hash, err := s.index.State(event.Name, info)
+		if err != nil {
+			log.Error().Err(err).Str("path", event.Name).Msg("Failed to hash file for broadcast")
+			return op, "", false
+		}
+		op.ContentPath = event.Name
+		op.Hash = hash
+		return op, hash, true
+	}
+	content, err := os.ReadFile(event.Name)
+	if err != nil {
+		log.Error().Err(err).Str("path", event.Name).Msg("Failed to read file for broadcast")
+		return op, "", false
+	}
+	op.Content = content
+	hash := common.HashBytes(content)
+	s.index.Put(event.Name, info, hash)
+	return op, hash, true
+}
+
+// flushState periodically saves what the watcher learned about changed files along with the
+// operation log, and saves both on shutdown
+func (s *Server) flushState() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(indexFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.index.Flush(); err != nil {
+				log.Error().Err(err).Msg("Failed to save file index")
+			}
+			if err := s.oplog.Flush(); err != nil {
+				log.Error().Err(err).Msg("Failed to save operation log")
+			}
+		case sig := <-signals:
+			log.Info().Str("signal", sig.String()).Msg("Shutting down, saving operation log")
+			// Held until exit, so the directory the log is saved against is final
+			s.opMutex.Lock()
+			manifest, err := common.BuildFileManifest(s.cfg.SyncDir, s.ignorer, s.symlinks, s.index)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to build file manifest, clients will resync after restart")
+				os.Exit(0)
+			}
+			if err := s.oplog.Close(common.NewManifestTree(&manifest).Root()); err != nil {
+				log.Error().Err(err).Msg("Failed to save operation log")
+			}
+			os.Exit(0)
+		}
+	}
+}